@@ -1,3 +1,7 @@
 module gpk
 
 go 1.23.0
+
+require gpk/listenfd v0.0.0
+
+replace gpk/listenfd => ./listenfd
@@ -1,3 +1,7 @@
 module gpk/http
 
 go 1.22.2
+
+require gpk/listenfd v0.0.0
+
+replace gpk/listenfd => ../listenfd
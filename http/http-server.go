@@ -1,8 +1,12 @@
 package http
 
 import (
+	"context"
+	"gpk/listenfd"
 	"gpk/logger"
+	"net"
 	"net/http"
+	"os"
 	"strconv"
 	"time"
 )
@@ -11,7 +15,7 @@ var s *HttpServer
 
 func init() {
 	s = &HttpServer{
-		&http.Server{
+		Server: &http.Server{
 			ReadTimeout:    5 * time.Minute,
 			WriteTimeout:   2 * time.Minute,
 			MaxHeaderBytes: 1 << 20,
@@ -23,6 +27,21 @@ func Run(port int) error {
 	return s.Run()
 }
 
+// 优先使用继承的监听套接字 (systemd socket activation 或父进程 Upgrade 传递)
+func RunInherited(port int) error {
+	s.SetAddress(":" + strconv.Itoa(port))
+	return s.RunInherited()
+}
+
+// 启动新进程并传递本进程所有服务 (包括 tcpserver) 的监听套接字，之后应调用 Shutdown 排空旧连接
+func Upgrade() (*os.Process, error) {
+	return listenfd.Upgrade()
+}
+
+func Shutdown(ctx context.Context) error {
+	return s.Shutdown(ctx)
+}
+
 func SetHandler(handler http.Handler) {
 	s.SetHandler(handler)
 }
@@ -43,3 +62,31 @@ func (s *HttpServer) Run() error {
 	logger.Info("http 服务启动完成，监听端口为 ", s.Addr)
 	return s.ListenAndServe()
 }
+
+func (s *HttpServer) RunInherited() error {
+	addr, err := net.ResolveTCPAddr("tcp", s.Addr)
+	if err != nil {
+		return err
+	}
+	// 未匹配的继承套接字留给本进程的其他服务
+	l, err := listenfd.Claim(addr)
+	if err != nil {
+		return err
+	}
+	if l == nil {
+		if l, err = net.Listen("tcp", s.Addr); err != nil {
+			return err
+		}
+		logger.Info("http 服务启动完成，监听端口为 ", s.Addr)
+	} else {
+		logger.Info("http 服务启动完成，使用继承的监听套接字 ", l.Addr())
+	}
+	listenfd.Register(l)
+	defer listenfd.Unregister(l)
+	return s.Serve(l)
+}
+
+// 启动新进程并传递本进程所有服务的监听套接字
+func (s *HttpServer) Upgrade() (*os.Process, error) {
+	return listenfd.Upgrade()
+}
@@ -0,0 +1,3 @@
+module gpk/listenfd
+
+go 1.22.2
@@ -0,0 +1,143 @@
+// Package listenfd shares listening sockets passed to the process (by
+// systemd socket activation or by a parent process using Upgrade(); the
+// LISTEN_FDS protocol) between all servers running in the process, and
+// passes the listeners of all servers on to a new process on upgrade.
+package listenfd
+
+import (
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// First file descriptor passed using socket activation (SD_LISTEN_FDS_START)
+const listenFdsStart = 3
+
+var (
+	mu         sync.Mutex
+	loaded     bool
+	loadErr    error
+	inherited  []net.Listener
+	registered []net.Listener
+)
+
+// Returns the inherited listener listening on addr or nil if there is none.
+// Each inherited listener is handed out only once.
+func Claim(addr net.Addr) (net.Listener, error) {
+	mu.Lock()
+	defer mu.Unlock()
+	if err := load(); err != nil {
+		return nil, err
+	}
+
+	for i, l := range inherited {
+		if SameAddr(l.Addr(), addr) {
+			inherited = append(inherited[:i], inherited[i+1:]...)
+			return l, nil
+		}
+	}
+	return nil, nil
+}
+
+// Returns all inherited listeners that have not been claimed yet
+func ClaimAll() ([]net.Listener, error) {
+	mu.Lock()
+	defer mu.Unlock()
+	if err := load(); err != nil {
+		return nil, err
+	}
+
+	listeners := inherited
+	inherited = nil
+	return listeners, nil
+}
+
+// Adds a listener to the listeners passed to the new process by Upgrade()
+func Register(l net.Listener) {
+	mu.Lock()
+	defer mu.Unlock()
+	for _, r := range registered {
+		if r == l {
+			return
+		}
+	}
+	registered = append(registered, l)
+}
+
+// Removes a listener from the listeners passed by Upgrade() (e.g. when it
+// is closed)
+func Unregister(l net.Listener) {
+	mu.Lock()
+	defer mu.Unlock()
+	for i, r := range registered {
+		if r == l {
+			registered = append(registered[:i], registered[i+1:]...)
+			return
+		}
+	}
+}
+
+// Parses the environment on first use; mu must be held. The environment is
+// left intact for other consumers in the process (LISTEN_* variables are
+// not passed on by Upgrade()).
+func load() error {
+	if loaded {
+		return loadErr
+	}
+	loaded = true
+
+	if pid := os.Getenv("LISTEN_PID"); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return nil
+	}
+	fds := os.Getenv("LISTEN_FDS")
+	if fds == "" {
+		return nil
+	}
+	n, err := strconv.Atoi(fds)
+	if err != nil {
+		loadErr = err
+		return err
+	}
+	names := strings.Split(os.Getenv("LISTEN_FDNAMES"), ":")
+
+	listeners := make([]net.Listener, 0, n)
+	for i := 0; i < n; i++ {
+		name := "LISTEN_FD_" + strconv.Itoa(listenFdsStart+i)
+		if i < len(names) && names[i] != "" {
+			name = names[i]
+		}
+		l, err := fileListener(uintptr(listenFdsStart+i), name)
+		if err != nil {
+			for _, l := range listeners {
+				_ = l.Close()
+			}
+			loadErr = err
+			return err
+		}
+		listeners = append(listeners, l)
+	}
+	inherited = listeners
+	return nil
+}
+
+// Checks whether both addresses denote the same listen address
+func SameAddr(a net.Addr, b net.Addr) bool {
+	switch x := a.(type) {
+	case *net.TCPAddr:
+		y, ok := b.(*net.TCPAddr)
+		if !ok || x.Port != y.Port {
+			return false
+		}
+		return x.IP.Equal(y.IP) || (isUnspecifiedIP(x.IP) && isUnspecifiedIP(y.IP))
+	case *net.UnixAddr:
+		y, ok := b.(*net.UnixAddr)
+		return ok && x.Name == y.Name
+	}
+	return false
+}
+
+func isUnspecifiedIP(ip net.IP) bool {
+	return len(ip) == 0 || ip.IsUnspecified()
+}
@@ -0,0 +1,19 @@
+//go:build !unix
+
+package listenfd
+
+import (
+	"fmt"
+	"net"
+	"os"
+)
+
+// Listener inheritance is not supported on this platform
+func fileListener(fd uintptr, name string) (net.Listener, error) {
+	return nil, fmt.Errorf("listener inheritance not supported")
+}
+
+// Listener inheritance is not supported on this platform
+func Upgrade() (*os.Process, error) {
+	return nil, fmt.Errorf("listener inheritance not supported")
+}
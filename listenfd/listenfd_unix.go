@@ -0,0 +1,93 @@
+//go:build unix
+
+package listenfd
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// Creates a listener from an inherited file descriptor
+func fileListener(fd uintptr, name string) (net.Listener, error) {
+	syscall.CloseOnExec(int(fd))
+	f := os.NewFile(fd, name)
+	defer f.Close()
+
+	l, err := net.FileListener(f)
+	if err != nil {
+		return nil, fmt.Errorf("error inheriting listener '%s': %s", name, err)
+	}
+	return l, nil
+}
+
+// Starts a new instance of the running binary (same arguments and
+// environment) and passes all registered listeners to it, so that every
+// server of the new process is able to claim its listener. Afterwards the
+// caller should gracefully drain its own connections.
+func Upgrade() (*os.Process, error) {
+	mu.Lock()
+	listeners := append([]net.Listener(nil), registered...)
+	mu.Unlock()
+
+	if len(listeners) == 0 {
+		return nil, fmt.Errorf("no listeners registered")
+	}
+
+	files := make([]*os.File, 0, len(listeners))
+	names := make([]string, 0, len(listeners))
+	defer func() {
+		for _, f := range files {
+			f.Close()
+		}
+	}()
+
+	for _, l := range listeners {
+		var (
+			f   *os.File
+			err error
+		)
+		switch l := l.(type) {
+		case *net.TCPListener:
+			f, err = l.File()
+		case *net.UnixListener:
+			// the socket file must survive closing our listener
+			l.SetUnlinkOnClose(false)
+			f, err = l.File()
+		default:
+			err = fmt.Errorf("unsupported listener type %T", l)
+		}
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, f)
+		names = append(names, strings.ReplaceAll(l.Addr().String(), ":", "_"))
+	}
+
+	executable, err := os.Executable()
+	if err != nil {
+		return nil, err
+	}
+
+	env := make([]string, 0, len(os.Environ())+2)
+	for _, v := range os.Environ() {
+		if !strings.HasPrefix(v, "LISTEN_") {
+			env = append(env, v)
+		}
+	}
+	env = append(env, "LISTEN_FDS="+strconv.Itoa(len(files)), "LISTEN_FDNAMES="+strings.Join(names, ":"))
+
+	wd, err := os.Getwd()
+	if err != nil {
+		return nil, err
+	}
+
+	return os.StartProcess(executable, os.Args, &os.ProcAttr{
+		Dir:   wd,
+		Env:   env,
+		Files: append([]*os.File{os.Stdin, os.Stdout, os.Stderr}, files...),
+	})
+}
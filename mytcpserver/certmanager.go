@@ -0,0 +1,253 @@
+package tcpserver
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Returned by CertManager.GetCertificate() if no certificate has been added
+var ErrNoCertificate = errors.New("tcpserver: no certificate available")
+
+// Certificate manager that serves multiple certificates selected by SNI and
+// reloads them atomically whenever the cert/key files change on disk.
+// Use as tls.Config.GetCertificate (see CertManager.TLSConfig() and
+// server.SetCertManager()).
+type CertManager struct {
+	mu      sync.RWMutex
+	entries []*certEntry
+	byName  map[string]*tls.Certificate
+	onError func(err error)
+	stop    chan struct{}
+	stopped sync.Once
+}
+
+// Single certificate loaded from disk
+type certEntry struct {
+	certFile string
+	keyFile  string
+	modTime  time.Time
+	cert     *tls.Certificate
+}
+
+// Creates a new certificate manager
+func NewCertManager() *CertManager {
+	return &CertManager{
+		byName: make(map[string]*tls.Certificate),
+		stop:   make(chan struct{}),
+	}
+}
+
+// Loads a certificate/key pair and adds it to the manager. The certificate
+// is served for all its DNS names (and common name); the first certificate
+// added is the default one for clients not sending SNI or unknown names.
+func (m *CertManager) AddCertificate(certFile string, keyFile string) error {
+	entry := &certEntry{certFile: certFile, keyFile: keyFile}
+	if err := entry.load(); err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.entries = append(m.entries, entry)
+	m.rebuildIndex()
+	return nil
+}
+
+// Sets function that is called with errors occuring during background reloads
+func (m *CertManager) SetErrorHandler(f func(err error)) {
+	m.mu.Lock()
+	m.onError = f
+	m.mu.Unlock()
+}
+
+// Reloads all certificates whose files have changed; certificates failing
+// to load are kept in their previous version
+func (m *CertManager) Reload() error {
+	m.mu.RLock()
+	entries := append([]*certEntry(nil), m.entries...)
+	m.mu.RUnlock()
+
+	var errs []error
+	updated := make(map[*certEntry]*certEntry)
+	for _, entry := range entries {
+		changed, err := entry.changed()
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		if !changed {
+			continue
+		}
+		fresh := &certEntry{certFile: entry.certFile, keyFile: entry.keyFile}
+		if err := fresh.load(); err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		updated[entry] = fresh
+	}
+
+	if len(updated) > 0 {
+		m.mu.Lock()
+		for i, entry := range m.entries {
+			if fresh, ok := updated[entry]; ok {
+				m.entries[i] = fresh
+			}
+		}
+		m.rebuildIndex()
+		m.mu.Unlock()
+	}
+
+	return errors.Join(errs...)
+}
+
+// Starts watching the certificate files for changes (polling every interval)
+func (m *CertManager) Watch(interval time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-m.stop:
+				return
+			case <-ticker.C:
+				if err := m.Reload(); err != nil {
+					m.mu.RLock()
+					onError := m.onError
+					m.mu.RUnlock()
+					if onError != nil {
+						onError(err)
+					}
+				}
+			}
+		}
+	}()
+}
+
+// Stops watching the certificate files
+func (m *CertManager) Stop() {
+	m.stopped.Do(func() {
+		close(m.stop)
+	})
+}
+
+// Returns the certificate for the requested server name (implements
+// tls.Config.GetCertificate)
+func (m *CertManager) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	if len(m.entries) == 0 {
+		return nil, ErrNoCertificate
+	}
+
+	name := strings.ToLower(strings.TrimSuffix(hello.ServerName, "."))
+	if name != "" {
+		if cert, ok := m.byName[name]; ok {
+			return cert, nil
+		}
+		if i := strings.IndexByte(name, '.'); i > 0 {
+			if cert, ok := m.byName["*"+name[i:]]; ok {
+				return cert, nil
+			}
+		}
+	}
+	return m.entries[0].cert, nil
+}
+
+// Returns a new TLS config using the manager for certificate selection
+func (m *CertManager) TLSConfig() *tls.Config {
+	return &tls.Config{
+		GetCertificate: m.GetCertificate,
+	}
+}
+
+// Rebuilds the SNI index; mu must be held. Earlier certificates take
+// precedence for duplicate names.
+func (m *CertManager) rebuildIndex() {
+	byName := make(map[string]*tls.Certificate)
+	for _, entry := range m.entries {
+		for _, name := range certNames(entry.cert.Leaf) {
+			if _, ok := byName[name]; !ok {
+				byName[name] = entry.cert
+			}
+		}
+	}
+	m.byName = byName
+}
+
+func (e *certEntry) load() error {
+	// taken before loading so that files rotated meanwhile are reloaded
+	// on the next check
+	modTime, err := e.latestModTime()
+	if err != nil {
+		return err
+	}
+
+	cert, err := tls.LoadX509KeyPair(e.certFile, e.keyFile)
+	if err != nil {
+		return fmt.Errorf("error loading certificate '%s': %s", e.certFile, err)
+	}
+	if cert.Leaf == nil {
+		if cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0]); err != nil {
+			return fmt.Errorf("error parsing certificate '%s': %s", e.certFile, err)
+		}
+	}
+
+	e.cert = &cert
+	e.modTime = modTime
+	return nil
+}
+
+// Checks whether cert or key file have been modified since loading
+func (e *certEntry) changed() (bool, error) {
+	modTime, err := e.latestModTime()
+	if err != nil {
+		return false, err
+	}
+	return !modTime.Equal(e.modTime), nil
+}
+
+func (e *certEntry) latestModTime() (time.Time, error) {
+	var latest time.Time
+	for _, file := range []string{e.certFile, e.keyFile} {
+		fi, err := os.Stat(file)
+		if err != nil {
+			return time.Time{}, err
+		}
+		if fi.ModTime().After(latest) {
+			latest = fi.ModTime()
+		}
+	}
+	return latest, nil
+}
+
+// Returns lower-cased DNS names and common name of a certificate
+func certNames(leaf *x509.Certificate) []string {
+	names := make([]string, 0, len(leaf.DNSNames)+1)
+	for _, name := range leaf.DNSNames {
+		names = append(names, strings.ToLower(name))
+	}
+	if cn := leaf.Subject.CommonName; cn != "" {
+		names = append(names, strings.ToLower(cn))
+	}
+	return names
+}
+
+// Uses the certificate manager for all TLS connections (server.ListenTLS()
+// as well as connection.StartTLS()). An existing TLS config is kept apart
+// from its certificates.
+func (s *Server) SetCertManager(m *CertManager) {
+	config := &tls.Config{}
+	if s.tlsConfig != nil {
+		config = s.tlsConfig.Clone()
+	}
+	config.Certificates = nil
+	config.GetCertificate = m.GetCertificate
+	s.SetTLSConfig(config)
+}
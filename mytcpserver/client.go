@@ -0,0 +1,349 @@
+package tcpserver
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"net"
+	"sync"
+	"time"
+)
+
+var (
+	// Returned by client operations after the client has been closed
+	ErrClientClosed = errors.New("tcpserver: client closed")
+	// Returned by client operations while the client is not connected
+	ErrNotConnected = errors.New("tcpserver: client not connected")
+)
+
+// Extracts the sequence ID used to match responses to requests from a frame
+type SequenceExtractorFunc func(frame []byte) (seq uint64, err error)
+
+// Handles frames received by a Client that are no response to a pending
+// request (e.g. notifications pushed by the peer)
+type ClientFrameHandlerFunc func(frame []byte)
+
+// Client config
+type ClientConfig struct {
+	// Address to dial
+	Addr string
+	// TLS config; nil for plain TCP
+	TLSConfig *tls.Config
+	// Codec used for framing (same codecs as on the server side)
+	Codec Codec
+	// Maximum frame size (defaults to DefaultMaxFrameSize)
+	MaxFrameSize int
+	// Extracts sequence IDs from frames; required for Request()
+	SequenceExtractor SequenceExtractorFunc
+	// Called for received frames not matching a pending request
+	FrameHandler ClientFrameHandlerFunc
+	// Called (in its own goroutine) whenever a connection has been
+	// established; frames are read concurrently, so it may use Request()
+	// e.g. to log in
+	OnConnect func(c *Client)
+	// Called whenever the connection has been lost
+	OnDisconnect func(c *Client, err error)
+	// Dial timeout (defaults to 10 seconds)
+	DialTimeout time.Duration
+	// Maximum time a frame write may take (defaults to 10 seconds); the
+	// connection is closed and re-established if a write times out
+	WriteTimeout time.Duration
+	// Maximum time without receiving any data after which the connection
+	// is considered dead and re-established (0 disables; use together with
+	// an application-level heartbeat)
+	IdleTimeout time.Duration
+	// TCP keep-alive period (defaults to 15 seconds; negative disables)
+	KeepAlive time.Duration
+	// Initial reconnect backoff (defaults to 100ms)
+	MinBackoff time.Duration
+	// Maximum reconnect backoff (defaults to 30s)
+	MaxBackoff time.Duration
+}
+
+// TCP client with automatic reconnects and request/response correlation
+type Client struct {
+	config  ClientConfig
+	ctx     context.Context
+	cancel  context.CancelFunc
+	mu      sync.Mutex
+	conn    net.Conn
+	framer  *Framer
+	ready   chan struct{}
+	pending map[uint64]chan []byte
+	wg      sync.WaitGroup
+}
+
+// Creates a new client and starts connecting in the background
+func NewClient(config *ClientConfig) (*Client, error) {
+	if config.Codec == nil {
+		return nil, errors.New("tcpserver: no codec given")
+	}
+
+	c := &Client{
+		config:  *config,
+		ready:   make(chan struct{}),
+		pending: make(map[uint64]chan []byte),
+	}
+	if c.config.MaxFrameSize <= 0 {
+		c.config.MaxFrameSize = DefaultMaxFrameSize
+	}
+	if c.config.DialTimeout <= 0 {
+		c.config.DialTimeout = 10 * time.Second
+	}
+	if c.config.WriteTimeout <= 0 {
+		c.config.WriteTimeout = 10 * time.Second
+	}
+	if c.config.KeepAlive == 0 {
+		c.config.KeepAlive = 15 * time.Second
+	}
+	if c.config.MinBackoff <= 0 {
+		c.config.MinBackoff = 100 * time.Millisecond
+	}
+	if c.config.MaxBackoff <= 0 {
+		c.config.MaxBackoff = 30 * time.Second
+	}
+	c.ctx, c.cancel = context.WithCancel(context.Background())
+
+	c.wg.Add(1)
+	go c.connectLoop()
+
+	return c, nil
+}
+
+// Waits until the client is connected or ctx is done
+func (c *Client) WaitConnected(ctx context.Context) error {
+	for {
+		c.mu.Lock()
+		ready, connected := c.ready, c.conn != nil
+		c.mu.Unlock()
+		if connected {
+			return nil
+		}
+
+		select {
+		case <-ready:
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-c.ctx.Done():
+			return ErrClientClosed
+		}
+	}
+}
+
+// Returns whether the client is currently connected
+func (c *Client) IsConnected() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.conn != nil
+}
+
+// Writes a frame to the peer; fails with ErrNotConnected while the client
+// is reconnecting
+func (c *Client) WriteFrame(frame []byte) error {
+	c.mu.Lock()
+	conn, framer := c.conn, c.framer
+	c.mu.Unlock()
+
+	if c.ctx.Err() != nil {
+		return ErrClientClosed
+	}
+	if framer == nil {
+		return ErrNotConnected
+	}
+	err := framer.WriteFrame(frame)
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		// the frame might have been written partially; reconnect
+		conn.Close()
+	}
+	return err
+}
+
+// Sends a request frame and waits for the response frame carrying the same
+// sequence ID (see ClientConfig.SequenceExtractor). While the client is
+// reconnecting, sending waits for the connection (bounded by ctx).
+func (c *Client) Request(ctx context.Context, frame []byte) ([]byte, error) {
+	if c.config.SequenceExtractor == nil {
+		return nil, errors.New("tcpserver: no sequence extractor set")
+	}
+	seq, err := c.config.SequenceExtractor(frame)
+	if err != nil {
+		return nil, err
+	}
+
+	respChan := make(chan []byte, 1)
+	c.mu.Lock()
+	if _, ok := c.pending[seq]; ok {
+		c.mu.Unlock()
+		return nil, errors.New("tcpserver: duplicate sequence ID")
+	}
+	c.pending[seq] = respChan
+	c.mu.Unlock()
+
+	defer func() {
+		c.mu.Lock()
+		if c.pending[seq] == respChan {
+			delete(c.pending, seq)
+		}
+		c.mu.Unlock()
+	}()
+
+	for {
+		if err = c.WaitConnected(ctx); err != nil {
+			return nil, err
+		}
+		if err = c.WriteFrame(frame); err != ErrNotConnected {
+			break
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	select {
+	case resp, ok := <-respChan:
+		if !ok {
+			return nil, ErrNotConnected
+		}
+		return resp, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-c.ctx.Done():
+		return nil, ErrClientClosed
+	}
+}
+
+// Closes the client and stops reconnecting
+func (c *Client) Close() error {
+	c.cancel()
+	c.mu.Lock()
+	if c.conn != nil {
+		_ = c.conn.Close()
+	}
+	c.mu.Unlock()
+	c.wg.Wait()
+	return nil
+}
+
+// Dials and serves the connection, reconnecting with exponential backoff
+func (c *Client) connectLoop() {
+	defer c.wg.Done()
+
+	backoff := c.config.MinBackoff
+	for c.ctx.Err() == nil {
+		conn, err := c.dial()
+		if err != nil {
+			select {
+			case <-time.After(backoff):
+			case <-c.ctx.Done():
+				return
+			}
+			if backoff *= 2; backoff > c.config.MaxBackoff {
+				backoff = c.config.MaxBackoff
+			}
+			continue
+		}
+		backoff = c.config.MinBackoff
+
+		err = c.serve(conn)
+		if c.config.OnDisconnect != nil && c.ctx.Err() == nil {
+			c.config.OnDisconnect(c, err)
+		}
+	}
+}
+
+func (c *Client) dial() (net.Conn, error) {
+	dialer := &net.Dialer{Timeout: c.config.DialTimeout, KeepAlive: c.config.KeepAlive}
+	if c.config.TLSConfig != nil {
+		return (&tls.Dialer{NetDialer: dialer, Config: c.config.TLSConfig}).DialContext(c.ctx, "tcp", c.config.Addr)
+	}
+	return dialer.DialContext(c.ctx, "tcp", c.config.Addr)
+}
+
+// Reads frames from conn until it fails
+func (c *Client) serve(conn net.Conn) error {
+	conn = &clientConn{Conn: conn, writeTimeout: c.config.WriteTimeout, idleTimeout: c.config.IdleTimeout}
+	framer := NewFramer(conn, c.config.Codec)
+	framer.SetMaxFrameSize(c.config.MaxFrameSize)
+
+	c.mu.Lock()
+	if c.ctx.Err() != nil {
+		c.mu.Unlock()
+		conn.Close()
+		return ErrClientClosed
+	}
+	c.conn, c.framer = conn, framer
+	close(c.ready)
+	c.mu.Unlock()
+
+	if c.config.OnConnect != nil {
+		go c.config.OnConnect(c)
+	}
+
+	var err error
+	for {
+		var frame []byte
+		if frame, err = framer.ReadFrame(); err != nil {
+			break
+		}
+		c.dispatch(frame)
+	}
+
+	conn.Close()
+	c.mu.Lock()
+	c.conn, c.framer = nil, nil
+	c.ready = make(chan struct{})
+	// fail all pending requests; they have to be retried on the new connection
+	for seq, respChan := range c.pending {
+		close(respChan)
+		delete(c.pending, seq)
+	}
+	c.mu.Unlock()
+
+	return err
+}
+
+// Passes a received frame to the pending request or the frame handler
+func (c *Client) dispatch(frame []byte) {
+	if c.config.SequenceExtractor != nil {
+		if seq, err := c.config.SequenceExtractor(frame); err == nil {
+			c.mu.Lock()
+			respChan, ok := c.pending[seq]
+			if ok {
+				delete(c.pending, seq)
+			}
+			c.mu.Unlock()
+			if ok {
+				respChan <- frame
+				return
+			}
+		}
+	}
+
+	if c.config.FrameHandler != nil {
+		c.config.FrameHandler(frame)
+	}
+}
+
+// Connection applying the client's write and idle timeouts
+type clientConn struct {
+	net.Conn
+	writeTimeout time.Duration
+	idleTimeout  time.Duration
+}
+
+func (c *clientConn) Read(b []byte) (int, error) {
+	if c.idleTimeout > 0 {
+		if err := c.Conn.SetReadDeadline(time.Now().Add(c.idleTimeout)); err != nil {
+			return 0, err
+		}
+	}
+	return c.Conn.Read(b)
+}
+
+func (c *clientConn) Write(b []byte) (int, error) {
+	if err := c.Conn.SetWriteDeadline(time.Now().Add(c.writeTimeout)); err != nil {
+		return 0, err
+	}
+	return c.Conn.Write(b)
+}
@@ -0,0 +1,288 @@
+package tcpserver
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+)
+
+// Default maximum frame size used by a Framer (4 MiB)
+const DefaultMaxFrameSize = 4 * 1024 * 1024
+
+var (
+	// Returned when a frame exceeds the framer's maximum frame size
+	ErrFrameTooLarge = errors.New("tcpserver: frame too large")
+	// Returned when a frame cannot be encoded by the codec
+	ErrInvalidFrame = errors.New("tcpserver: invalid frame")
+)
+
+// Codec defines how message boundaries are encoded on the wire
+type Codec interface {
+	// Reads exactly one frame from r; frames larger than maxSize must be
+	// rejected with ErrFrameTooLarge
+	ReadFrame(r *bufio.Reader, maxSize int) ([]byte, error)
+	// Encodes frame and writes it to w using a single Write call
+	WriteFrame(w io.Writer, frame []byte) error
+}
+
+// Framer reads and writes whole frames from/to a connection using a Codec
+type Framer struct {
+	rw           io.ReadWriter
+	r            *bufio.Reader
+	codec        Codec
+	maxFrameSize int
+	wmu          sync.Mutex
+}
+
+// Creates a new framer on top of rw (usually a Connection)
+func NewFramer(rw io.ReadWriter, codec Codec) *Framer {
+	return &Framer{
+		rw:           rw,
+		r:            bufio.NewReader(rw),
+		codec:        codec,
+		maxFrameSize: DefaultMaxFrameSize,
+	}
+}
+
+// Sets maximum frame size for both reading and writing
+func (f *Framer) SetMaxFrameSize(size int) {
+	f.maxFrameSize = size
+}
+
+// Returns maximum frame size
+func (f *Framer) GetMaxFrameSize() int {
+	return f.maxFrameSize
+}
+
+// Returns the codec
+func (f *Framer) GetCodec() Codec {
+	return f.codec
+}
+
+// Reads the next frame; not safe for concurrent use
+func (f *Framer) ReadFrame() ([]byte, error) {
+	return f.codec.ReadFrame(f.r, f.maxFrameSize)
+}
+
+// Writes a frame; safe for concurrent use
+func (f *Framer) WriteFrame(frame []byte) error {
+	if len(frame) > f.maxFrameSize {
+		return ErrFrameTooLarge
+	}
+	f.wmu.Lock()
+	defer f.wmu.Unlock()
+	return f.codec.WriteFrame(f.rw, frame)
+}
+
+// Length-prefixed framing: each frame is preceded by its payload length
+// encoded as unsigned integer of 1, 2 or 4 bytes
+type LengthPrefixCodec struct {
+	// Size of length header in bytes (1, 2 or 4)
+	Size int
+	// Byte order of length header (defaults to big endian)
+	ByteOrder binary.ByteOrder
+}
+
+// Creates a length-prefixed codec with a big endian header of given size
+func NewLengthPrefixCodec(size int) *LengthPrefixCodec {
+	return &LengthPrefixCodec{Size: size, ByteOrder: binary.BigEndian}
+}
+
+func (c *LengthPrefixCodec) order() binary.ByteOrder {
+	if c.ByteOrder == nil {
+		return binary.BigEndian
+	}
+	return c.ByteOrder
+}
+
+// Returns the largest payload length the header is able to represent
+func (c *LengthPrefixCodec) maxLength() (uint64, error) {
+	switch c.Size {
+	case 1:
+		return 1<<8 - 1, nil
+	case 2:
+		return 1<<16 - 1, nil
+	case 4:
+		return 1<<32 - 1, nil
+	}
+	return 0, fmt.Errorf("tcpserver: invalid length prefix size %d", c.Size)
+}
+
+func (c *LengthPrefixCodec) ReadFrame(r *bufio.Reader, maxSize int) ([]byte, error) {
+	if _, err := c.maxLength(); err != nil {
+		return nil, err
+	}
+
+	var header [4]byte
+	if _, err := io.ReadFull(r, header[:c.Size]); err != nil {
+		return nil, err
+	}
+
+	var length uint64
+	switch c.Size {
+	case 1:
+		length = uint64(header[0])
+	case 2:
+		length = uint64(c.order().Uint16(header[:2]))
+	case 4:
+		length = uint64(c.order().Uint32(header[:4]))
+	}
+	if length > uint64(maxSize) {
+		return nil, ErrFrameTooLarge
+	}
+
+	frame := make([]byte, length)
+	if _, err := io.ReadFull(r, frame); err != nil {
+		return nil, unexpectedEOF(err)
+	}
+	return frame, nil
+}
+
+func (c *LengthPrefixCodec) WriteFrame(w io.Writer, frame []byte) error {
+	max, err := c.maxLength()
+	if err != nil {
+		return err
+	}
+	if uint64(len(frame)) > max {
+		return ErrFrameTooLarge
+	}
+
+	buf := make([]byte, c.Size, c.Size+len(frame))
+	switch c.Size {
+	case 1:
+		buf[0] = byte(len(frame))
+	case 2:
+		c.order().PutUint16(buf, uint16(len(frame)))
+	case 4:
+		c.order().PutUint32(buf, uint32(len(frame)))
+	}
+	_, err = w.Write(append(buf, frame...))
+	return err
+}
+
+// Delimiter-based framing: each frame is terminated by Delimiter (e.g. "\r\n").
+// The delimiter is stripped on read and appended on write.
+type DelimiterCodec struct {
+	Delimiter []byte
+}
+
+// Creates a delimiter-based codec
+func NewDelimiterCodec(delimiter []byte) *DelimiterCodec {
+	return &DelimiterCodec{Delimiter: delimiter}
+}
+
+func (c *DelimiterCodec) ReadFrame(r *bufio.Reader, maxSize int) ([]byte, error) {
+	delim := c.Delimiter
+	if len(delim) == 0 {
+		return nil, fmt.Errorf("tcpserver: empty frame delimiter")
+	}
+
+	last := delim[len(delim)-1]
+	var frame []byte
+	for {
+		chunk, err := r.ReadSlice(last)
+		if len(frame)+len(chunk) > maxSize+len(delim) {
+			return nil, ErrFrameTooLarge
+		}
+		frame = append(frame, chunk...)
+
+		if err == bufio.ErrBufferFull {
+			continue
+		}
+		if err != nil {
+			if len(frame) > 0 {
+				err = unexpectedEOF(err)
+			}
+			return nil, err
+		}
+		if bytes.HasSuffix(frame, delim) {
+			return frame[:len(frame)-len(delim)], nil
+		}
+	}
+}
+
+func (c *DelimiterCodec) WriteFrame(w io.Writer, frame []byte) error {
+	if len(c.Delimiter) == 0 {
+		return fmt.Errorf("tcpserver: empty frame delimiter")
+	}
+	if bytes.Contains(frame, c.Delimiter) {
+		return ErrInvalidFrame
+	}
+	buf := make([]byte, 0, len(frame)+len(c.Delimiter))
+	buf = append(buf, frame...)
+	_, err := w.Write(append(buf, c.Delimiter...))
+	return err
+}
+
+// Fixed-size framing: every frame has exactly Size bytes
+type FixedSizeCodec struct {
+	Size int
+}
+
+// Creates a fixed-size codec
+func NewFixedSizeCodec(size int) *FixedSizeCodec {
+	return &FixedSizeCodec{Size: size}
+}
+
+func (c *FixedSizeCodec) ReadFrame(r *bufio.Reader, maxSize int) ([]byte, error) {
+	if c.Size > maxSize {
+		return nil, ErrFrameTooLarge
+	}
+	frame := make([]byte, c.Size)
+	if _, err := io.ReadFull(r, frame); err != nil {
+		return nil, err
+	}
+	return frame, nil
+}
+
+func (c *FixedSizeCodec) WriteFrame(w io.Writer, frame []byte) error {
+	if len(frame) != c.Size {
+		return ErrInvalidFrame
+	}
+	_, err := w.Write(frame)
+	return err
+}
+
+// Varint framing: each frame is preceded by its payload length encoded as
+// unsigned varint (as used by protobuf's delimited messages)
+type VarintCodec struct{}
+
+// Creates a varint length-prefixed codec
+func NewVarintCodec() *VarintCodec {
+	return &VarintCodec{}
+}
+
+func (c *VarintCodec) ReadFrame(r *bufio.Reader, maxSize int) ([]byte, error) {
+	length, err := binary.ReadUvarint(r)
+	if err != nil {
+		return nil, err
+	}
+	if length > uint64(maxSize) {
+		return nil, ErrFrameTooLarge
+	}
+
+	frame := make([]byte, length)
+	if _, err := io.ReadFull(r, frame); err != nil {
+		return nil, unexpectedEOF(err)
+	}
+	return frame, nil
+}
+
+func (c *VarintCodec) WriteFrame(w io.Writer, frame []byte) error {
+	buf := make([]byte, 0, binary.MaxVarintLen64+len(frame))
+	buf = binary.AppendUvarint(buf, uint64(len(frame)))
+	_, err := w.Write(append(buf, frame...))
+	return err
+}
+
+// Converts io.EOF into io.ErrUnexpectedEOF for partially read frames
+func unexpectedEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
@@ -0,0 +1,129 @@
+package tcpserver
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestCodecRoundTrip(t *testing.T) {
+	t.Parallel()
+
+	frames := [][]byte{[]byte("hello"), {}, bytes.Repeat([]byte{0xAB}, 300)}
+	codecs := map[string]Codec{
+		"length1":   NewLengthPrefixCodec(1),
+		"length2":   NewLengthPrefixCodec(2),
+		"length4":   NewLengthPrefixCodec(4),
+		"length4le": &LengthPrefixCodec{Size: 4, ByteOrder: binary.LittleEndian},
+		"varint":    NewVarintCodec(),
+		"delim":     NewDelimiterCodec([]byte("\r\n")),
+	}
+
+	for name, codec := range codecs {
+		var buf bytes.Buffer
+		var written [][]byte
+		for _, frame := range frames {
+			if err := codec.WriteFrame(&buf, frame); err != nil {
+				if name == "length1" && len(frame) > 255 && errors.Is(err, ErrFrameTooLarge) {
+					continue
+				}
+				t.Fatalf("%s: error writing frame: %s", name, err)
+			}
+			written = append(written, frame)
+		}
+
+		r := bufio.NewReader(&buf)
+		for _, want := range written {
+			got, err := codec.ReadFrame(r, DefaultMaxFrameSize)
+			if err != nil {
+				t.Fatalf("%s: error reading frame: %s", name, err)
+			}
+			if !bytes.Equal(got, want) {
+				t.Fatalf("%s: got %q, want %q", name, got, want)
+			}
+		}
+		if _, err := codec.ReadFrame(r, DefaultMaxFrameSize); err != io.EOF {
+			t.Fatalf("%s: got %v, want EOF", name, err)
+		}
+	}
+}
+
+func TestFixedSizeCodec(t *testing.T) {
+	t.Parallel()
+
+	codec := NewFixedSizeCodec(4)
+	if err := codec.WriteFrame(io.Discard, []byte("abc")); !errors.Is(err, ErrInvalidFrame) {
+		t.Fatalf("got %v, want ErrInvalidFrame", err)
+	}
+
+	r := bufio.NewReader(strings.NewReader("abcdefgh"))
+	for _, want := range []string{"abcd", "efgh"} {
+		frame, err := codec.ReadFrame(r, DefaultMaxFrameSize)
+		if err != nil || string(frame) != want {
+			t.Fatalf("got %q (%v), want %q", frame, err, want)
+		}
+	}
+}
+
+func TestCodecFrameTooLarge(t *testing.T) {
+	t.Parallel()
+
+	var buf bytes.Buffer
+	_ = NewLengthPrefixCodec(2).WriteFrame(&buf, make([]byte, 100))
+	if _, err := NewLengthPrefixCodec(2).ReadFrame(bufio.NewReader(&buf), 99); !errors.Is(err, ErrFrameTooLarge) {
+		t.Fatalf("length prefix: got %v, want ErrFrameTooLarge", err)
+	}
+
+	buf.Reset()
+	_ = NewVarintCodec().WriteFrame(&buf, make([]byte, 100))
+	if _, err := NewVarintCodec().ReadFrame(bufio.NewReader(&buf), 99); !errors.Is(err, ErrFrameTooLarge) {
+		t.Fatalf("varint: got %v, want ErrFrameTooLarge", err)
+	}
+
+	r := bufio.NewReader(strings.NewReader(strings.Repeat("x", 100) + "\n"))
+	if _, err := NewDelimiterCodec([]byte("\n")).ReadFrame(r, 99); !errors.Is(err, ErrFrameTooLarge) {
+		t.Fatalf("delimiter: got %v, want ErrFrameTooLarge", err)
+	}
+
+	framer := NewFramer(&buf, NewVarintCodec())
+	framer.SetMaxFrameSize(10)
+	if err := framer.WriteFrame(make([]byte, 11)); !errors.Is(err, ErrFrameTooLarge) {
+		t.Fatalf("framer: got %v, want ErrFrameTooLarge", err)
+	}
+}
+
+func TestCodecTruncatedFrame(t *testing.T) {
+	t.Parallel()
+
+	r := bufio.NewReader(bytes.NewReader([]byte{0, 5, 'a', 'b'}))
+	if _, err := NewLengthPrefixCodec(2).ReadFrame(r, DefaultMaxFrameSize); err != io.ErrUnexpectedEOF {
+		t.Fatalf("length prefix: got %v, want ErrUnexpectedEOF", err)
+	}
+
+	r = bufio.NewReader(strings.NewReader("no delimiter"))
+	if _, err := NewDelimiterCodec([]byte("\r\n")).ReadFrame(r, DefaultMaxFrameSize); err != io.ErrUnexpectedEOF {
+		t.Fatalf("delimiter: got %v, want ErrUnexpectedEOF", err)
+	}
+}
+
+func TestDelimiterCodecSplitDelimiter(t *testing.T) {
+	t.Parallel()
+
+	// the delimiter's last byte also appears inside the frame
+	codec := NewDelimiterCodec([]byte("\r\n"))
+	r := bufio.NewReader(strings.NewReader("a\nb\r\nc\r\n"))
+	for _, want := range []string{"a\nb", "c"} {
+		frame, err := codec.ReadFrame(r, DefaultMaxFrameSize)
+		if err != nil || string(frame) != want {
+			t.Fatalf("got %q (%v), want %q", frame, err, want)
+		}
+	}
+
+	if err := codec.WriteFrame(io.Discard, []byte("x\r\ny")); !errors.Is(err, ErrInvalidFrame) {
+		t.Fatalf("got %v, want ErrInvalidFrame", err)
+	}
+}
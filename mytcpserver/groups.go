@@ -0,0 +1,191 @@
+package tcpserver
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Adds the connection to the named group (e.g. a room, tenant or device type);
+// does nothing if the connection has been finished
+func (conn *TCPConn) JoinGroup(name string) {
+	s := conn.server
+	if s == nil {
+		return
+	}
+
+	// lock order is connsMu, groupsMu (see trackConn())
+	s.connsMu.Lock()
+	defer s.connsMu.Unlock()
+	if s.conns[conn.id] != conn {
+		return
+	}
+	s.groupsMu.Lock()
+	defer s.groupsMu.Unlock()
+
+	members, ok := s.groups[name]
+	if !ok {
+		members = make(map[uint64]*TCPConn)
+		s.groups[name] = members
+	}
+	if _, ok := members[conn.id]; ok {
+		return
+	}
+	members[conn.id] = conn
+	conn.groups = append(conn.groups, name)
+}
+
+// Removes the connection from the named group
+func (conn *TCPConn) LeaveGroup(name string) {
+	s := conn.server
+	if s == nil {
+		return
+	}
+
+	s.groupsMu.Lock()
+	defer s.groupsMu.Unlock()
+	s.removeFromGroup(conn, name)
+	for i, g := range conn.groups {
+		if g == name {
+			conn.groups = append(conn.groups[:i], conn.groups[i+1:]...)
+			break
+		}
+	}
+}
+
+// Returns names of all groups the connection is a member of
+func (conn *TCPConn) GetGroups() []string {
+	s := conn.server
+	if s == nil {
+		return nil
+	}
+
+	s.groupsMu.RLock()
+	defer s.groupsMu.RUnlock()
+	return append([]string(nil), conn.groups...)
+}
+
+// Returns names of all non-empty groups
+func (s *Server) GetGroups() []string {
+	s.groupsMu.RLock()
+	names := make([]string, 0, len(s.groups))
+	for name := range s.groups {
+		names = append(names, name)
+	}
+	s.groupsMu.RUnlock()
+
+	sort.Strings(names)
+	return names
+}
+
+// Returns all members of the named group (see server.GetConnection() on
+// keeping connections returned)
+func (s *Server) GetGroupMembers(name string) []Connection {
+	members := s.pinGroupMembers(name)
+	s.connsMu.Lock()
+	for _, conn := range members {
+		conn.published = true
+	}
+	s.connsMu.Unlock()
+
+	conns := make([]Connection, len(members))
+	for i, conn := range members {
+		conns[i] = conn
+		s.unpinConn(conn)
+	}
+	return conns
+}
+
+// Returns pinned live members of the named group (ordered by connection
+// ID); each one has to be released using unpinConn()
+func (s *Server) pinGroupMembers(name string) []*TCPConn {
+	s.groupsMu.RLock()
+	ids := make([]uint64, 0, len(s.groups[name]))
+	members := make(map[uint64]*TCPConn, len(s.groups[name]))
+	for id, conn := range s.groups[name] {
+		ids = append(ids, id)
+		members[id] = conn
+	}
+	s.groupsMu.RUnlock()
+
+	sort.Slice(ids, func(i, j int) bool {
+		return ids[i] < ids[j]
+	})
+
+	conns := make([]*TCPConn, 0, len(ids))
+	for _, id := range ids {
+		if s.pinConn(members[id], id) {
+			conns = append(conns, members[id])
+		}
+	}
+	return conns
+}
+
+// Writes data to all members of the named group in parallel, each write
+// limited by timeout (0 uses the server's write timeout or 10 seconds if
+// none is set) so that a single
+// slow peer cannot stall the broadcast. Returns the number of members the
+// data has been successfully written to and the joined errors of all
+// failed writes.
+// Note that data is written concurrently to writes done by the connection
+// handlers; make sure your protocol can cope with that.
+func (s *Server) Broadcast(name string, data []byte, timeout time.Duration) (sent int, err error) {
+	if timeout <= 0 {
+		timeout = s.writeTimeout
+	}
+	if timeout <= 0 {
+		timeout = 10 * time.Second
+	}
+	members := s.pinGroupMembers(name)
+
+	var (
+		wg      sync.WaitGroup
+		success int32
+		errsMu  sync.Mutex
+		errs    []error
+	)
+
+	for _, conn := range members {
+		wg.Add(1)
+		go func(conn *TCPConn) {
+			defer wg.Done()
+			defer s.unpinConn(conn)
+			if _, err := conn.WriteTimeout(data, timeout); err != nil {
+				errsMu.Lock()
+				errs = append(errs, fmt.Errorf("connection %d: %w", conn.id, err))
+				errsMu.Unlock()
+				return
+			}
+			atomic.AddInt32(&success, 1)
+		}(conn)
+	}
+	wg.Wait()
+
+	return int(success), errors.Join(errs...)
+}
+
+// Removes connection from the named group; groupsMu must be held
+func (s *Server) removeFromGroup(conn *TCPConn, name string) {
+	members, ok := s.groups[name]
+	if !ok {
+		return
+	}
+	delete(members, conn.id)
+	if len(members) == 0 {
+		delete(s.groups, name)
+	}
+}
+
+// Removes connection from all groups (called by trackConn() when the
+// connection is finished)
+func (s *Server) leaveAllGroups(conn *TCPConn) {
+	s.groupsMu.Lock()
+	defer s.groupsMu.Unlock()
+	for _, name := range conn.groups {
+		s.removeFromGroup(conn, name)
+	}
+	conn.groups = nil
+}
@@ -0,0 +1,106 @@
+package tcpserver
+
+import (
+	"fmt"
+	"sync/atomic"
+	"time"
+)
+
+// Application-level heartbeat config
+type HeartbeatConfig struct {
+	// Time without any data received from the peer after which a heartbeat
+	// counts as missed (and a ping is sent)
+	Interval time.Duration
+	// Number of missed heartbeats after which the connection is closed
+	// (defaults to 3)
+	MaxMissed int
+	// Ping frame written to the connection for every missed heartbeat;
+	// nil disables sending pings (the peer is expected to send heartbeats
+	// on its own)
+	PingFrame []byte
+	// Sends a ping (takes precedence over PingFrame); useful for pings that
+	// depend on the connection, e.g. framed using a Framer
+	PingFunc func(conn Connection) error
+}
+
+// Enables heartbeat handling; connections that did not send any data for
+// Interval * MaxMissed are closed with CloseReasonHeartbeatTimeout. Must be
+// called before Serve(); use nil to disable.
+func (s *Server) SetHeartbeat(config *HeartbeatConfig) error {
+	if config == nil {
+		s.heartbeat = nil
+		return nil
+	}
+	if config.Interval <= 0 {
+		return fmt.Errorf("invalid heartbeat interval %s", config.Interval)
+	}
+	hb := *config
+	if hb.MaxMissed < 1 {
+		hb.MaxMissed = 3
+	}
+	s.heartbeat = &hb
+	return nil
+}
+
+// Returns time the peer has sent data the last time
+func (conn *TCPConn) GetLastRead() time.Time {
+	ts := atomic.LoadInt64(&conn.lastRead)
+	return time.Unix(ts/1e9, ts%1e9)
+}
+
+// Checks all connections for missed heartbeats until the server shuts down
+func (s *Server) heartbeatLoop() {
+	hb := s.heartbeat
+	tick := hb.Interval / 2
+	if tick < 10*time.Millisecond {
+		tick = 10 * time.Millisecond
+	}
+
+	ticker := time.NewTicker(tick)
+	defer ticker.Stop()
+
+	done := s.connBaseContext().Done()
+	for {
+		select {
+		case <-done:
+			return
+		case now := <-ticker.C:
+			for _, conn := range s.pinConns() {
+				s.checkHeartbeat(conn, hb, now)
+				s.unpinConn(conn)
+			}
+		}
+	}
+}
+
+// Sends a ping for each newly missed heartbeat and closes the connection
+// once too many have been missed
+func (s *Server) checkHeartbeat(conn *TCPConn, hb *HeartbeatConfig, now time.Time) {
+	missed := int32(now.Sub(conn.GetLastRead()) / hb.Interval)
+	if missed <= 0 {
+		atomic.StoreInt32(&conn.heartbeatsMissed, 0)
+		return
+	}
+
+	if int(missed) >= hb.MaxMissed {
+		conn.setCloseReason(CloseReasonHeartbeatTimeout)
+		_ = conn.Conn.Close()
+		return
+	}
+
+	if prev := atomic.SwapInt32(&conn.heartbeatsMissed, missed); prev == missed {
+		return
+	}
+
+	if (hb.PingFunc == nil && hb.PingFrame == nil) || !s.pinConn(conn, conn.id) {
+		return
+	}
+	go func() {
+		defer s.unpinConn(conn)
+		if hb.PingFunc != nil {
+			_ = hb.PingFunc(conn)
+		} else {
+			_, _ = conn.WriteTimeout(hb.PingFrame, hb.Interval)
+		}
+	}()
+}
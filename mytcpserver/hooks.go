@@ -0,0 +1,200 @@
+package tcpserver
+
+import (
+	"errors"
+	"io"
+	"net"
+	"sync/atomic"
+	"time"
+)
+
+// Reason why a connection has been closed
+type CloseReason int32
+
+const (
+	CloseReasonUnknown CloseReason = iota
+	// The request handler returned
+	CloseReasonHandlerDone
+	// The peer closed the connection
+	CloseReasonPeerClosed
+	// A read, write or idle timeout occurred
+	CloseReasonTimeout
+	// The connection was kicked using server.Kick()
+	CloseReasonKicked
+	// The connection was forcibly closed on server shutdown
+	CloseReasonShutdown
+	// The TLS handshake failed
+	CloseReasonHandshakeFailed
+	// The connect hook or the identity authorizer returned an error
+	CloseReasonRejected
+	// The request handler failed
+	CloseReasonError
+	// The request handler panicked
+	CloseReasonPanic
+	// The peer missed too many heartbeats
+	CloseReasonHeartbeatTimeout
+)
+
+var closeReasonNames = map[CloseReason]string{
+	CloseReasonUnknown:          "unknown",
+	CloseReasonHandlerDone:      "handler done",
+	CloseReasonPeerClosed:       "peer closed",
+	CloseReasonTimeout:          "timeout",
+	CloseReasonKicked:           "kicked",
+	CloseReasonShutdown:         "server shutdown",
+	CloseReasonHandshakeFailed:  "TLS handshake failed",
+	CloseReasonRejected:         "rejected",
+	CloseReasonError:            "handler error",
+	CloseReasonPanic:            "handler panic",
+	CloseReasonHeartbeatTimeout: "heartbeat timeout",
+}
+
+func (r CloseReason) String() string {
+	if name, ok := closeReasonNames[r]; ok {
+		return name
+	}
+	return "unknown"
+}
+
+// Information passed to the close hook
+type CloseInfo struct {
+	Duration     time.Duration
+	BytesRead    int64
+	BytesWritten int64
+	Reason       CloseReason
+}
+
+// Called for each accepted connection (after the PROXY header has been
+// read but before the TLS handshake); return false to reject the connection
+type AcceptHookFunc func(netConn net.Conn) bool
+
+// Called after the TLS handshake (if any) and before the request handler;
+// returning an error closes the connection
+type ConnectHookFunc func(conn Connection) error
+
+// Called after a connection has been closed
+type CloseHookFunc func(conn Connection, info *CloseInfo)
+
+// Called for errors occuring while serving a connection
+type ErrorHookFunc func(conn Connection, err error)
+
+// Sets accept hook
+func (s *Server) SetOnAccept(f AcceptHookFunc) {
+	s.onAccept = f
+}
+
+// Sets connect hook
+func (s *Server) SetOnConnect(f ConnectHookFunc) {
+	s.onConnect = f
+}
+
+// Sets close hook
+func (s *Server) SetOnClose(f CloseHookFunc) {
+	s.onClose = f
+}
+
+// Sets error hook
+func (s *Server) SetOnError(f ErrorHookFunc) {
+	s.onError = f
+}
+
+// Returns number of bytes read from the connection
+func (conn *TCPConn) GetBytesRead() int64 {
+	return atomic.LoadInt64(&conn.bytesRead)
+}
+
+// Returns number of bytes written to the connection
+func (conn *TCPConn) GetBytesWritten() int64 {
+	return atomic.LoadInt64(&conn.bytesWritten)
+}
+
+// Sets the reason the connection is going to be closed for; only the first
+// reason set is kept
+func (conn *TCPConn) setCloseReason(reason CloseReason) {
+	atomic.CompareAndSwapInt32(&conn.closeReason, int32(CloseReasonUnknown), int32(reason))
+}
+
+// Returns the reason the connection has been closed for
+func (conn *TCPConn) getCloseReason() CloseReason {
+	if reason := CloseReason(atomic.LoadInt32(&conn.closeReason)); reason != CloseReasonUnknown {
+		return reason
+	}
+	if reason := CloseReason(atomic.LoadInt32(&conn.readErrReason)); reason != CloseReasonUnknown {
+		return reason
+	}
+	return CloseReasonHandlerDone
+}
+
+// Remembers the last read error as potential close reason
+func (conn *TCPConn) trackReadError(err error) {
+	reason := CloseReasonUnknown
+	var netErr net.Error
+	switch {
+	case err == nil:
+	case errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF):
+		reason = CloseReasonPeerClosed
+	case errors.As(err, &netErr) && netErr.Timeout():
+		reason = CloseReasonTimeout
+	case errors.Is(err, net.ErrClosed):
+		return
+	default:
+		reason = CloseReasonPeerClosed
+	}
+	atomic.StoreInt32(&conn.readErrReason, int32(reason))
+}
+
+// Runs the accept hook
+func (s *Server) acceptHook(netConn net.Conn) bool {
+	if s.onAccept == nil || s.onAccept(netConn) {
+		return true
+	}
+	return s.reject()
+}
+
+// Detects TLS (if auto TLS is enabled or a protocol mux is set), completes the TLS handshake (if
+// TLS is used), authorizes the client identity and runs the connect hook
+func (s *Server) connectConn(conn *TCPConn) error {
+	if s.mux != nil {
+		if err := s.mux.detectTLS(conn); err != nil {
+			return err
+		}
+	} else if s.autoTLSEnabled {
+		if err := conn.detectTLS(s.GetTLSConfig()); err != nil {
+			return err
+		}
+	}
+	if err := conn.Handshake(); err != nil {
+		return err
+	}
+	if err := s.authorizeIdentity(conn); err != nil {
+		return err
+	}
+
+	if s.onConnect != nil {
+		if err := s.onConnect(conn); err != nil {
+			conn.setCloseReason(CloseReasonRejected)
+			return err
+		}
+	}
+	return nil
+}
+
+// Runs the error hook
+func (s *Server) errorHook(conn Connection, err error) {
+	if s.onError != nil {
+		s.onError(conn, err)
+	}
+}
+
+// Runs the close hook
+func (s *Server) closeHook(conn *TCPConn) {
+	if s.onClose == nil {
+		return
+	}
+	s.onClose(conn, &CloseInfo{
+		Duration:     time.Since(conn.GetStartTime()),
+		BytesRead:    conn.GetBytesRead(),
+		BytesWritten: conn.GetBytesWritten(),
+		Reason:       conn.getCloseReason(),
+	})
+}
@@ -0,0 +1,119 @@
+package tcpserver
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"net"
+	"net/url"
+	"sync/atomic"
+)
+
+var (
+	// Returned by GetPeerIdentity() if the connection does not use TLS
+	ErrNotTLS = errors.New("tcpserver: connection does not use TLS")
+	// Returned by GetPeerIdentity() if the peer did not send a certificate
+	ErrNoPeerCertificate = errors.New("tcpserver: no peer certificate")
+)
+
+// Identity of a TLS client taken from its certificate
+type PeerIdentity struct {
+	CommonName     string
+	DNSNames       []string
+	EmailAddresses []string
+	IPAddresses    []net.IP
+	URIs           []*url.URL
+	// Hex encoded SHA-256 fingerprint of the certificate
+	Fingerprint string
+	// Whether the certificate chain has been verified (see tls.Config.ClientAuth)
+	Verified    bool
+	Certificate *x509.Certificate
+}
+
+// Authorizes a client identity before the request handler runs; id is nil
+// if the client did not send a certificate. Returning an error closes the
+// connection.
+type IdentityAuthorizerFunc func(conn Connection, id *PeerIdentity) error
+
+// Sets identity authorizer that is called for every TLS connection
+func (s *Server) SetIdentityAuthorizer(f IdentityAuthorizerFunc) {
+	s.identityAuthorizer = f
+}
+
+// Completes the TLS handshake (no-op for non-TLS connections or if the
+// handshake has already been completed). The handshake is limited by the
+// server's read timeout and aborted on shutdown.
+func (conn *TCPConn) Handshake() error {
+	tlsConn, ok := conn.Conn.(*tls.Conn)
+	if !ok {
+		return nil
+	}
+
+	ctx := *conn.GetContext()
+	if conn.server != nil && conn.server.readTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, conn.server.readTimeout)
+		defer cancel()
+	}
+
+	err := tlsConn.HandshakeContext(ctx)
+	if err != nil && conn.server != nil {
+		atomic.AddInt64(&conn.server.metrics.handshakeFailures, 1)
+		conn.setCloseReason(CloseReasonHandshakeFailed)
+	}
+	return err
+}
+
+// Completes the TLS handshake and returns the identity of the client
+// certificate
+func (conn *TCPConn) GetPeerIdentity() (*PeerIdentity, error) {
+	tlsConn, ok := conn.Conn.(*tls.Conn)
+	if !ok {
+		return nil, ErrNotTLS
+	}
+	if err := conn.Handshake(); err != nil {
+		return nil, err
+	}
+
+	state := tlsConn.ConnectionState()
+	if len(state.PeerCertificates) == 0 {
+		return nil, ErrNoPeerCertificate
+	}
+
+	cert := state.PeerCertificates[0]
+	fingerprint := sha256.Sum256(cert.Raw)
+	return &PeerIdentity{
+		CommonName:     cert.Subject.CommonName,
+		DNSNames:       cert.DNSNames,
+		EmailAddresses: cert.EmailAddresses,
+		IPAddresses:    cert.IPAddresses,
+		URIs:           cert.URIs,
+		Fingerprint:    hex.EncodeToString(fingerprint[:]),
+		Verified:       len(state.VerifiedChains) > 0,
+		Certificate:    cert,
+	}, nil
+}
+
+// Runs the identity authorizer for TLS connections
+func (s *Server) authorizeIdentity(conn *TCPConn) error {
+	if s.identityAuthorizer == nil {
+		return nil
+	}
+	if _, ok := conn.Conn.(*tls.Conn); !ok {
+		return nil
+	}
+
+	id, err := conn.GetPeerIdentity()
+	if err != nil && err != ErrNoPeerCertificate {
+		return err
+	}
+	if err = s.identityAuthorizer(conn, id); err != nil {
+		conn.setCloseReason(CloseReasonRejected)
+		s.reject()
+		return err
+	}
+	return nil
+}
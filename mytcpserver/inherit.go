@@ -0,0 +1,58 @@
+package tcpserver
+
+import (
+	"net"
+	"os"
+
+	"gpk/listenfd"
+)
+
+// Returns listeners passed by systemd socket activation or by a parent
+// process using Upgrade() (LISTEN_FDS protocol) that have not been claimed
+// by any server of the process yet (see ListenInherited()). The listeners
+// are handed out only once; subsequent calls return nil.
+func InheritedListeners() ([]net.Listener, error) {
+	return listenfd.ClaimAll()
+}
+
+// Uses given listener (e.g. an inherited one) for the matching listen
+// address or as additional listener. Must be called before Listen().
+func (s *Server) AddListener(l net.Listener) {
+	s.providedListeners = append(s.providedListeners, l)
+}
+
+// Starts listening like Listen() but uses listeners passed by systemd
+// socket activation or by a parent process (see Upgrade()) for matching
+// listen addresses. Inherited listeners not matching any listen address are
+// left for other servers of the process (see InheritedListeners()).
+func (s *Server) ListenInherited() error {
+	for _, addr := range s.listenAddrs {
+		l, err := listenfd.Claim(addr)
+		if err != nil {
+			return err
+		}
+		if l != nil {
+			s.AddListener(l)
+		}
+	}
+	return s.Listen()
+}
+
+// Starts a new instance of the running binary (same arguments and
+// environment) and passes the listeners of all servers of the process to
+// it (including e.g. the http package's listener). The child picks them up
+// using ListenInherited(); afterwards the caller should gracefully drain
+// its own connections using Shutdown().
+func (s *Server) Upgrade() (*os.Process, error) {
+	return listenfd.Upgrade()
+}
+
+// Returns index of the listener listening on addr or -1
+func indexListener(listeners []net.Listener, addr net.Addr) int {
+	for i, l := range listeners {
+		if listenfd.SameAddr(l.Addr(), addr) {
+			return i
+		}
+	}
+	return -1
+}
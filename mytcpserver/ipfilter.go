@@ -0,0 +1,120 @@
+package tcpserver
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync/atomic"
+)
+
+// Returned when a connection is rejected by the IP filter
+var ErrConnectionDenied = errors.New("tcpserver: connection denied")
+
+// IP based access control using allow and deny CIDR lists (IPv4 and IPv6).
+// Deny rules take precedence; if the allow list is non-empty, only matching
+// addresses are allowed.
+type IPFilter struct {
+	allow []*net.IPNet
+	deny  []*net.IPNet
+}
+
+// Creates a new IP filter; entries are either CIDRs ("10.0.0.0/8",
+// "fd00::/8") or single IP addresses
+func NewIPFilter(allow []string, deny []string) (*IPFilter, error) {
+	f := &IPFilter{}
+	var err error
+	if f.allow, err = parseCIDRs(allow); err != nil {
+		return nil, err
+	}
+	if f.deny, err = parseCIDRs(deny); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// Checks whether given IP is allowed by the filter
+func (f *IPFilter) Allowed(ip net.IP) bool {
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
+	if containsIP(f.deny, ip) {
+		return false
+	}
+	return len(f.allow) == 0 || containsIP(f.allow, ip)
+}
+
+// Checks whether given address is allowed by the filter
+func (f *IPFilter) AllowedAddr(addr *net.TCPAddr) bool {
+	return f.Allowed(addr.IP)
+}
+
+// Sets (or replaces) the IP filter; safe to call while the server is
+// running. Use nil to disable filtering.
+func (s *Server) SetIPFilter(f *IPFilter) {
+	s.ipFilter.Store(f)
+}
+
+// Returns current IP filter (nil if none is set)
+func (s *Server) GetIPFilter() *IPFilter {
+	return s.ipFilter.Load()
+}
+
+// Returns number of connections rejected by the IP filter
+func (s *Server) GetDeniedConnections() int32 {
+	return atomic.LoadInt32(&s.deniedConnections)
+}
+
+// Checks accepted connection against the IP filter (Unix domain socket
+// connections are not filtered)
+func (s *Server) filterConn(netConn net.Conn) bool {
+	f := s.ipFilter.Load()
+	if f == nil {
+		return true
+	}
+	addr, ok := netConn.RemoteAddr().(*net.TCPAddr)
+	if !ok {
+		_, isUnix := netConn.RemoteAddr().(*net.UnixAddr)
+		return isUnix
+	}
+	if f.AllowedAddr(addr) {
+		return true
+	}
+	atomic.AddInt32(&s.deniedConnections, 1)
+	return false
+}
+
+func parseCIDRs(entries []string) ([]*net.IPNet, error) {
+	nets := make([]*net.IPNet, 0, len(entries))
+	for _, entry := range entries {
+		entry = strings.TrimSpace(entry)
+		if !strings.Contains(entry, "/") {
+			ip := net.ParseIP(entry)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid IP address '%s'", entry)
+			}
+			if ip4 := ip.To4(); ip4 != nil {
+				nets = append(nets, &net.IPNet{IP: ip4, Mask: net.CIDRMask(32, 32)})
+			} else {
+				nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(128, 128)})
+			}
+			continue
+		}
+
+		_, ipNet, err := net.ParseCIDR(entry)
+		if err != nil {
+			return nil, fmt.Errorf("invalid CIDR '%s': %s", entry, err)
+		}
+		nets = append(nets, ipNet)
+	}
+	return nets, nil
+}
+
+func containsIP(nets []*net.IPNet, ip net.IP) bool {
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
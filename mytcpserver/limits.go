@@ -0,0 +1,187 @@
+package tcpserver
+
+import (
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Connection limits checked in the accept loop before a connection is
+// handed over to the worker pool (for connections from trusted PROXY
+// protocol peers, once the original client address is known)
+type Limits struct {
+	// Maximum number of concurrent connections (0 = unlimited)
+	MaxConnections int
+	// Whether to queue new connections until a slot becomes available
+	// instead of rejecting them once MaxConnections is reached
+	QueueWhenFull bool
+	// Maximum number of concurrent connections per client IP (0 = unlimited)
+	MaxConnectionsPerIP int
+	// Maximum number of accepted connections per second per client IP (0 = unlimited)
+	AcceptRatePerIP float64
+	// Number of connections a client IP may open at once before
+	// AcceptRatePerIP kicks in (defaults to 1)
+	AcceptBurstPerIP int
+}
+
+// State required to enforce Limits
+type limiter struct {
+	limits     Limits
+	slots      chan struct{}
+	mu         sync.Mutex
+	perIP      map[string]int
+	buckets    map[string]*tokenBucket
+	lastPurged time.Time
+}
+
+// Sets connection limits; must be called before Serve()
+func (s *Server) SetLimits(limits *Limits) {
+	if limits == nil {
+		s.limiter = nil
+		return
+	}
+
+	l := &limiter{
+		limits:  *limits,
+		perIP:   make(map[string]int),
+		buckets: make(map[string]*tokenBucket),
+	}
+	if limits.MaxConnections > 0 {
+		l.slots = make(chan struct{}, limits.MaxConnections)
+	}
+	s.limiter = l
+}
+
+// Returns connection limits (nil if none are set)
+func (s *Server) GetLimits() *Limits {
+	if s.limiter == nil {
+		return nil
+	}
+	limits := s.limiter.limits
+	return &limits
+}
+
+// Returns number of connections rejected by limits
+func (s *Server) GetRejectedConnections() int32 {
+	return atomic.LoadInt32(&s.rejectedConnections)
+}
+
+// Checks whether a freshly accepted connection is admitted according to the
+// server's limits; in queue mode this blocks until a slot becomes available
+// or the server shuts down. Admitted connections must be released using
+// releaseConn().
+func (s *Server) admitConn(netConn net.Conn) bool {
+	l := s.limiter
+	if l == nil {
+		return true
+	}
+
+	if l.slots != nil {
+		if l.limits.QueueWhenFull {
+			select {
+			case l.slots <- struct{}{}:
+			case <-s.connBaseContext().Done():
+				return s.reject()
+			}
+		} else {
+			select {
+			case l.slots <- struct{}{}:
+			default:
+				return s.reject()
+			}
+		}
+	}
+
+	if !l.admitIP(remoteIP(netConn.RemoteAddr())) {
+		if l.slots != nil {
+			<-l.slots
+		}
+		return s.reject()
+	}
+	return true
+}
+
+// Releases the resources acquired by admitConn()
+func (s *Server) releaseConn(netConn net.Conn) {
+	l := s.limiter
+	if l == nil {
+		return
+	}
+
+	if ip := remoteIP(netConn.RemoteAddr()); ip != "" && l.limits.MaxConnectionsPerIP > 0 {
+		l.mu.Lock()
+		if l.perIP[ip]--; l.perIP[ip] <= 0 {
+			delete(l.perIP, ip)
+		}
+		l.mu.Unlock()
+	}
+	if l.slots != nil {
+		<-l.slots
+	}
+}
+
+func (s *Server) reject() bool {
+	atomic.AddInt32(&s.rejectedConnections, 1)
+	return false
+}
+
+// Checks per-IP concurrency and accept rate limits (not applied to
+// connections without IP, i.e. Unix domain sockets)
+func (l *limiter) admitIP(ip string) bool {
+	if ip == "" || (l.limits.MaxConnectionsPerIP <= 0 && l.limits.AcceptRatePerIP <= 0) {
+		return true
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	if l.limits.AcceptRatePerIP > 0 {
+		l.purgeBuckets(now)
+		bucket, ok := l.buckets[ip]
+		if !ok {
+			bucket = newTokenBucket(l.limits.AcceptRatePerIP, l.limits.AcceptBurstPerIP)
+			l.buckets[ip] = bucket
+		}
+		if !bucket.allow(now, 1) {
+			return false
+		}
+	}
+
+	if max := l.limits.MaxConnectionsPerIP; max > 0 {
+		if l.perIP[ip] >= max {
+			return false
+		}
+		l.perIP[ip]++
+	}
+	return true
+}
+
+// Removes rate limit buckets that are full again (at most once a minute)
+func (l *limiter) purgeBuckets(now time.Time) {
+	if now.Sub(l.lastPurged) < time.Minute {
+		return
+	}
+	l.lastPurged = now
+	for ip, bucket := range l.buckets {
+		if bucket.isFull(now) {
+			delete(l.buckets, ip)
+		}
+	}
+}
+
+// Returns IP part of addr as string ("" for Unix domain socket addresses)
+func remoteIP(addr net.Addr) string {
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		return a.IP.String()
+	case *net.UnixAddr, nil:
+		return ""
+	}
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return addr.String()
+	}
+	return host
+}
@@ -0,0 +1,148 @@
+package tcpserver
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// Upper bounds (in seconds) of the connection duration histogram buckets;
+// changes only affect servers created afterwards
+var DurationBuckets = []float64{0.1, 0.5, 1, 5, 10, 30, 60, 300, 900, 3600, 4 * 3600, 24 * 3600}
+
+// Server-wide counters
+type metrics struct {
+	bytesRead         int64
+	bytesWritten      int64
+	acceptErrors      int64
+	handshakeFailures int64
+	durationBuckets   []float64
+	durationCounts    []uint64
+	durationCount     uint64
+	durationSumNanos  int64
+}
+
+func newMetrics() *metrics {
+	return &metrics{
+		durationBuckets: append([]float64(nil), DurationBuckets...),
+		durationCounts:  make([]uint64, len(DurationBuckets)),
+	}
+}
+
+// Adds a connection duration to the histogram
+func (m *metrics) observeDuration(d time.Duration) {
+	seconds := d.Seconds()
+	for i, bound := range m.durationBuckets {
+		if seconds <= bound {
+			atomic.AddUint64(&m.durationCounts[i], 1)
+			break
+		}
+	}
+	atomic.AddUint64(&m.durationCount, 1)
+	atomic.AddInt64(&m.durationSumNanos, int64(d))
+}
+
+// Single (cumulative) histogram bucket
+type HistogramBucket struct {
+	UpperBound float64
+	Count      uint64
+}
+
+// Histogram snapshot
+type Histogram struct {
+	Buckets []HistogramBucket
+	Count   uint64
+	Sum     float64
+}
+
+// Server statistics snapshot
+type Stats struct {
+	ActiveConnections   int32
+	AcceptedConnections int32
+	RejectedConnections int32
+	DeniedConnections   int32
+	KilledConnections   int32
+	BytesRead           int64
+	BytesWritten        int64
+	AcceptErrors        int64
+	HandshakeFailures   int64
+	// Histogram of connection durations in seconds
+	ConnectionDurations Histogram
+}
+
+// Returns a snapshot of the server's statistics
+func (s *Server) GetStats() *Stats {
+	m := s.metrics
+	stats := &Stats{
+		ActiveConnections:   s.GetActiveConnections(),
+		AcceptedConnections: s.GetAcceptedConnections(),
+		RejectedConnections: s.GetRejectedConnections(),
+		DeniedConnections:   s.GetDeniedConnections(),
+		KilledConnections:   s.GetKilledConnections(),
+		BytesRead:           atomic.LoadInt64(&m.bytesRead),
+		BytesWritten:        atomic.LoadInt64(&m.bytesWritten),
+		AcceptErrors:        atomic.LoadInt64(&m.acceptErrors),
+		HandshakeFailures:   atomic.LoadInt64(&m.handshakeFailures),
+	}
+
+	h := &stats.ConnectionDurations
+	h.Buckets = make([]HistogramBucket, len(m.durationBuckets))
+	var cumulative uint64
+	for i, bound := range m.durationBuckets {
+		cumulative += atomic.LoadUint64(&m.durationCounts[i])
+		h.Buckets[i] = HistogramBucket{UpperBound: bound, Count: cumulative}
+	}
+	h.Count = atomic.LoadUint64(&m.durationCount)
+	h.Sum = time.Duration(atomic.LoadInt64(&m.durationSumNanos)).Seconds()
+
+	return stats
+}
+
+// Returns an http.Handler exposing the server's statistics in Prometheus
+// text format, e.g. to be mounted on the http package's server:
+//
+//	mux.Handle("/metrics", server.MetricsHandler())
+func (s *Server) MetricsHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		s.GetStats().WritePrometheus(w, "tcpserver")
+	})
+}
+
+// Writes statistics in Prometheus text format using given metric name prefix
+func (stats *Stats) WritePrometheus(w io.Writer, prefix string) {
+	metric := func(name, typ, help string, value interface{}) {
+		fmt.Fprintf(w, "# HELP %s_%s %s\n# TYPE %s_%s %s\n%s_%s %v\n", prefix, name, help, prefix, name, typ, prefix, name, value)
+	}
+
+	metric("active_connections", "gauge", "Number of currently active connections.", stats.ActiveConnections)
+	metric("accepted_connections_total", "counter", "Number of accepted connections.", stats.AcceptedConnections)
+	metric("rejected_connections_total", "counter", "Number of connections rejected by limits or hooks.", stats.RejectedConnections)
+	metric("denied_connections_total", "counter", "Number of connections denied by the IP filter.", stats.DeniedConnections)
+	metric("killed_connections_total", "counter", "Number of connections forcibly closed on shutdown.", stats.KilledConnections)
+	metric("read_bytes_total", "counter", "Number of bytes read.", stats.BytesRead)
+	metric("written_bytes_total", "counter", "Number of bytes written.", stats.BytesWritten)
+	metric("accept_errors_total", "counter", "Number of errors while accepting connections.", stats.AcceptErrors)
+	metric("tls_handshake_failures_total", "counter", "Number of failed TLS handshakes.", stats.HandshakeFailures)
+
+	name := prefix + "_connection_duration_seconds"
+	h := stats.ConnectionDurations
+	fmt.Fprintf(w, "# HELP %s Duration of closed connections.\n# TYPE %s histogram\n", name, name)
+	for _, b := range h.Buckets {
+		fmt.Fprintf(w, "%s_bucket{le=\"%s\"} %d\n", name, formatFloat(b.UpperBound), b.Count)
+	}
+	fmt.Fprintf(w, "%s_bucket{le=\"+Inf\"} %d\n", name, h.Count)
+	fmt.Fprintf(w, "%s_sum %s\n", name, formatFloat(h.Sum))
+	fmt.Fprintf(w, "%s_count %d\n", name, h.Count)
+}
+
+func formatFloat(f float64) string {
+	if math.IsInf(f, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
@@ -0,0 +1,324 @@
+package tcpserver
+
+import (
+	"bytes"
+	"crypto/tls"
+	"net"
+	"sync"
+)
+
+// Maximum number of bytes the protocol mux peeks at
+const muxPeekSize = 16
+
+// Result of a protocol matcher
+type MatchResult int
+
+const (
+	// The data does not belong to the protocol
+	MatchFailed MatchResult = iota
+	// The data belongs to the protocol
+	MatchOK
+	// More data is needed to decide
+	MatchNeedMore
+)
+
+// Checks whether the first bytes of a connection belong to a protocol
+type ProtocolMatcherFunc func(peek []byte) MatchResult
+
+// Dispatches connections to different handlers depending on the first
+// bytes sent by the client, so that several protocols can be served on a
+// single port. Use server.SetProtocolMux(mux) to serve all connections.
+type ProtocolMux struct {
+	mu        sync.RWMutex
+	routes    []muxRoute
+	fallback  RequestHandlerFunc
+	listeners []*muxListener
+}
+
+type muxRoute struct {
+	match     ProtocolMatcherFunc
+	handler   RequestHandlerFunc
+	tls       bool
+	tlsConfig *tls.Config
+}
+
+// Creates a new protocol mux
+func NewProtocolMux() *ProtocolMux {
+	return &ProtocolMux{}
+}
+
+// Registers handler for connections matching match; routes are checked in
+// the order they have been added
+func (m *ProtocolMux) Handle(match ProtocolMatcherFunc, handler RequestHandlerFunc) {
+	m.mu.Lock()
+	m.routes = append(m.routes, muxRoute{match: match, handler: handler})
+	m.mu.Unlock()
+}
+
+// Registers handler for TLS connections; TLS is terminated using config
+// (or the server's TLS config if nil) and the client identity is authorized
+// (see server.SetIdentityAuthorizer()) before handler is called
+func (m *ProtocolMux) HandleTLS(config *tls.Config, handler RequestHandlerFunc) {
+	m.mu.Lock()
+	m.routes = append(m.routes, muxRoute{match: MatchTLS, handler: handler, tls: true, tlsConfig: config})
+	m.mu.Unlock()
+}
+
+// Serves all connections using the protocol mux. Connections for TLS routes
+// (see mux.HandleTLS()) are detected before the TLS handshake, so that the
+// identity authorizer and the connect hook run after the handshake just
+// like with server.EnableAutoTLS().
+func (s *Server) SetProtocolMux(m *ProtocolMux) {
+	s.mux = m
+	s.requestHandler = m.ServeConn
+}
+
+// Returns a virtual listener receiving all connections matching match.
+// It can be passed to e.g. http.Server.Serve() to serve HTTP on the same
+// port. Connections are held open until closed by the consumer of the
+// listener; make sure to shut down that consumer (e.g. http.Server.Shutdown())
+// along with the tcpserver.
+func (m *ProtocolMux) Listener(match ProtocolMatcherFunc) net.Listener {
+	l := &muxListener{
+		conns:  make(chan net.Conn),
+		closed: make(chan struct{}),
+	}
+	m.mu.Lock()
+	m.listeners = append(m.listeners, l)
+	m.mu.Unlock()
+
+	m.Handle(match, func(conn Connection) {
+		mc := &muxConn{Connection: conn, done: make(chan struct{})}
+		select {
+		case l.conns <- mc:
+			<-mc.done
+		case <-l.closed:
+		}
+	})
+	return l
+}
+
+// Returns a virtual listener receiving all plaintext HTTP connections, to
+// be used with http.Server.Serve()
+func (m *ProtocolMux) HTTPListener() net.Listener {
+	return m.Listener(MatchHTTP)
+}
+
+// Sets handler for connections not matching any route (by default these
+// are closed)
+func (m *ProtocolMux) SetFallback(handler RequestHandlerFunc) {
+	m.mu.Lock()
+	m.fallback = handler
+	m.mu.Unlock()
+}
+
+// Closes all virtual listeners
+func (m *ProtocolMux) Close() error {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	for _, l := range m.listeners {
+		l.Close()
+	}
+	return nil
+}
+
+// Peeks at the first bytes of the connection and dispatches it; peeking
+// continues until all routes are able to decide (limited by the server's
+// read timeout)
+func (m *ProtocolMux) ServeConn(conn Connection) {
+	tcpConn := conn.(*TCPConn)
+	route, err := m.route(tcpConn)
+	if err != nil || route == nil {
+		return
+	}
+
+	if route.tls && !tcpConn.IsTLS() {
+		// the mux is used as plain request handler (not using
+		// server.SetProtocolMux()), so TLS has to be started here
+		if err := tcpConn.StartTLS(route.tlsConfig); err != nil {
+			return
+		}
+		if err := tcpConn.Handshake(); err != nil {
+			return
+		}
+		if s := tcpConn.server; s != nil {
+			if err := s.authorizeIdentity(tcpConn); err != nil {
+				return
+			}
+		}
+	}
+	route.handler(conn)
+}
+
+// Starts TLS if the connection belongs to a TLS route (called before the
+// handshake if the mux has been set using server.SetProtocolMux())
+func (m *ProtocolMux) detectTLS(conn *TCPConn) error {
+	if conn.IsTLS() {
+		return nil
+	}
+	route, err := m.route(conn)
+	if err != nil || route == nil || !route.tls {
+		return err
+	}
+	return conn.StartTLS(route.tlsConfig)
+}
+
+// Returns the route for the connection (nil if neither a route nor a
+// fallback handler matches). Connections on which TLS has been started by
+// the mux or by auto TLS detection belong to the first TLS route; if there
+// is none, the decrypted data is matched.
+func (m *ProtocolMux) route(conn *TCPConn) (*muxRoute, error) {
+	if conn.IsTLS() && !conn.server.tlsAlways() {
+		m.mu.RLock()
+		for i := range m.routes {
+			if m.routes[i].tls {
+				route := m.routes[i]
+				m.mu.RUnlock()
+				return &route, nil
+			}
+		}
+		m.mu.RUnlock()
+	}
+
+	min := 1
+	for {
+		peek, err := conn.peek(min, muxPeekSize)
+		if err != nil {
+			return nil, err
+		}
+		if route, ok := m.match(peek, len(peek) >= muxPeekSize); ok {
+			return route, nil
+		}
+		min = len(peek) + 1
+	}
+}
+
+// Checks routes in order; returns false if more data is needed to decide
+// (unless final is set)
+func (m *ProtocolMux) match(peek []byte, final bool) (*muxRoute, bool) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	for i := range m.routes {
+		switch m.routes[i].match(peek) {
+		case MatchOK:
+			route := m.routes[i]
+			return &route, true
+		case MatchNeedMore:
+			if !final {
+				return nil, false
+			}
+		}
+	}
+	if m.fallback == nil {
+		return nil, true
+	}
+	return &muxRoute{handler: m.fallback}, true
+}
+
+// Matches a TLS handshake record (ClientHello)
+func MatchTLS(peek []byte) MatchResult {
+	return matchBytes(peek, []byte{0x16, 0x03})
+}
+
+var httpMethods = [][]byte{
+	[]byte("GET "), []byte("POST "), []byte("PUT "), []byte("HEAD "),
+	[]byte("DELETE "), []byte("OPTIONS "), []byte("PATCH "), []byte("CONNECT "),
+	[]byte("TRACE "), []byte("PRI * HTTP/2"),
+}
+
+// Matches a plaintext HTTP request line (at least the first three bytes of
+// the method are required)
+func MatchHTTP(peek []byte) MatchResult {
+	result := MatchFailed
+	for _, method := range httpMethods {
+		switch matchBytes(peek, method[:3]) {
+		case MatchOK:
+			if matchBytes(peek, method) != MatchFailed {
+				return MatchOK
+			}
+		case MatchNeedMore:
+			result = MatchNeedMore
+		}
+	}
+	return result
+}
+
+// Returns a matcher checking for given prefix (e.g. a magic number of a
+// binary protocol)
+func MatchPrefix(prefix []byte) ProtocolMatcherFunc {
+	return func(peek []byte) MatchResult {
+		return matchBytes(peek, prefix)
+	}
+}
+
+// Matches everything
+func MatchAny(peek []byte) MatchResult {
+	return MatchOK
+}
+
+// Checks whether peek starts with prefix
+func matchBytes(peek []byte, prefix []byte) MatchResult {
+	if len(peek) < len(prefix) {
+		if bytes.HasPrefix(prefix, peek) {
+			return MatchNeedMore
+		}
+		return MatchFailed
+	}
+	if bytes.HasPrefix(peek, prefix) {
+		return MatchOK
+	}
+	return MatchFailed
+}
+
+// Connection handed to a virtual listener; Close() releases the request
+// handler waiting for the consumer to finish
+type muxConn struct {
+	Connection
+	done chan struct{}
+	once sync.Once
+}
+
+func (c *muxConn) Close() error {
+	err := c.Connection.Close()
+	c.once.Do(func() {
+		close(c.done)
+	})
+	return err
+}
+
+// Virtual listener fed by ProtocolMux
+type muxListener struct {
+	conns     chan net.Conn
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+func (l *muxListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.closed:
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *muxListener) Close() error {
+	l.closeOnce.Do(func() {
+		close(l.closed)
+	})
+	return nil
+}
+
+func (l *muxListener) Addr() net.Addr {
+	return muxAddr{}
+}
+
+type muxAddr struct{}
+
+func (muxAddr) Network() string {
+	return "tcpserver-mux"
+}
+
+func (muxAddr) String() string {
+	return "tcpserver-mux"
+}
@@ -0,0 +1,65 @@
+package tcpserver
+
+import (
+	"bufio"
+	"io"
+	"net"
+)
+
+// Connection reading from a buffer holding data that has already been
+// peeked at; used to start TLS on a connection after peeking
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufferedConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+// Returns at least one and at most n bytes of incoming data without
+// consuming it (e.g. for protocol detection); only blocks until the first
+// byte is available. Subject to the server's read and idle timeouts.
+func (conn *TCPConn) Peek(n int) ([]byte, error) {
+	return conn.peek(1, n)
+}
+
+// Returns at least min and at most max bytes of incoming data without
+// consuming it; blocks until min bytes are available. The underlying
+// net.Conn is kept as is, so that TLS detection etc. is not affected.
+func (conn *TCPConn) peek(min int, max int) ([]byte, error) {
+	if conn.peeked == nil {
+		conn.peeked = bufio.NewReader(conn.Conn)
+	}
+
+	op := conn.applyReadDeadline()
+	if _, err := conn.peeked.Peek(min); err != nil {
+		return nil, wrapTimeoutError(op, err)
+	}
+	if buffered := conn.peeked.Buffered(); max > buffered {
+		max = buffered
+	}
+	return conn.peeked.Peek(max)
+}
+
+// Returns the reader connection.Read() reads from: the peek buffer as long
+// as it holds data, the net.Conn afterwards
+func (conn *TCPConn) reader() io.Reader {
+	if conn.peeked != nil {
+		if conn.peeked.Buffered() > 0 {
+			return conn.peeked
+		}
+		conn.peeked = nil
+	}
+	return conn.Conn
+}
+
+// Moves data peeked at below a TLS layer that is about to be started
+func (conn *TCPConn) unpeek() net.Conn {
+	if conn.peeked == nil {
+		return conn.Conn
+	}
+	netConn := &bufferedConn{Conn: conn.Conn, r: conn.peeked}
+	conn.peeked = nil
+	return netConn
+}
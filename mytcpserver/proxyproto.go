@@ -0,0 +1,284 @@
+package tcpserver
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Returned when a connection sends a malformed PROXY protocol header
+var ErrInvalidProxyHeader = errors.New("tcpserver: invalid PROXY protocol header")
+
+var (
+	proxyV1Prefix  = []byte("PROXY ")
+	proxyV2Sig     = []byte("\r\n\r\n\x00\r\nQUIT\n")
+	proxyV1MaxLine = 107
+)
+
+// PROXY protocol (v1 and v2) config, see
+// https://www.haproxy.org/download/2.8/doc/proxy-protocol.txt
+type ProxyProtocolConfig struct {
+	// Proxies (CIDRs or IPs) that are allowed to send a PROXY header;
+	// connections from other addresses are served as is
+	TrustedProxies []string
+	// Trust all peers instead of TrustedProxies; any client is able to
+	// pretend to be coming from any address then
+	TrustAll bool
+	// Maximum time to wait for the header (defaults to 5 seconds)
+	HeaderTimeout time.Duration
+	// Whether trusted peers must send a header; otherwise connections
+	// without header (or not sending anything within HeaderTimeout) are
+	// served as is
+	Required bool
+}
+
+type proxyProtocol struct {
+	trusted       *IPFilter
+	headerTimeout time.Duration
+	required      bool
+}
+
+// Enables PROXY protocol parsing on accepted connections so that
+// GetClientAddr() and GetServerAddr() return the original endpoints.
+// For connections from trusted proxies, the IP filter and limits (see
+// SetLimits()) are applied to the original client address once the header
+// has been read. Use nil to disable.
+func (s *Server) SetProxyProtocol(config *ProxyProtocolConfig) error {
+	if config == nil {
+		s.proxyProtocol = nil
+		return nil
+	}
+
+	pp := &proxyProtocol{
+		headerTimeout: config.HeaderTimeout,
+		required:      config.Required,
+	}
+	if pp.headerTimeout <= 0 {
+		pp.headerTimeout = 5 * time.Second
+	}
+	if !config.TrustAll {
+		if len(config.TrustedProxies) == 0 {
+			return fmt.Errorf("no trusted proxies given (use TrustAll to trust all peers)")
+		}
+		trusted, err := NewIPFilter(config.TrustedProxies, nil)
+		if err != nil {
+			return err
+		}
+		pp.trusted = trusted
+	}
+	s.proxyProtocol = pp
+	return nil
+}
+
+// Connection with addresses taken from the PROXY header
+type proxyConn struct {
+	net.Conn
+	r          *bufio.Reader
+	remoteAddr net.Addr
+	localAddr  net.Addr
+}
+
+func (c *proxyConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+func (c *proxyConn) RemoteAddr() net.Addr {
+	return c.remoteAddr
+}
+
+func (c *proxyConn) LocalAddr() net.Addr {
+	return c.localAddr
+}
+
+// Reads the PROXY header from trusted peers and returns a connection
+// reporting the original addresses
+func (pp *proxyProtocol) wrapConn(netConn net.Conn) (net.Conn, error) {
+	if !pp.trusts(netConn) {
+		return netConn, nil
+	}
+
+	if err := netConn.SetReadDeadline(time.Now().Add(pp.headerTimeout)); err != nil {
+		return nil, err
+	}
+
+	pc := &proxyConn{
+		Conn:       netConn,
+		r:          bufio.NewReader(netConn),
+		remoteAddr: netConn.RemoteAddr(),
+		localAddr:  netConn.LocalAddr(),
+	}
+	if err := pc.readHeader(pp.required); err != nil {
+		return nil, err
+	}
+
+	if err := netConn.SetReadDeadline(time.Time{}); err != nil {
+		return nil, err
+	}
+	return pc, nil
+}
+
+// Returns whether the connection's peer is allowed to send a PROXY header
+func (pp *proxyProtocol) trusts(netConn net.Conn) bool {
+	if pp.trusted == nil {
+		return true
+	}
+	addr, ok := netConn.RemoteAddr().(*net.TCPAddr)
+	return ok && pp.trusted.AllowedAddr(addr)
+}
+
+// Returns whether the IP filter and limits of an accepted connection are
+// deferred until the PROXY header has been read (see serveConn())
+func (s *Server) deferAdmission(netConn net.Conn) bool {
+	return s.proxyProtocol != nil && s.proxyProtocol.trusts(netConn)
+}
+
+// Detects and parses a v1 or v2 header
+func (c *proxyConn) readHeader(required bool) error {
+	first, err := c.r.Peek(1)
+	if err != nil {
+		var netErr net.Error
+		if !required && errors.As(err, &netErr) && netErr.Timeout() {
+			// nothing sent yet (e.g. a server-speaks-first protocol)
+			return nil
+		}
+		return err
+	}
+
+	switch first[0] {
+	case proxyV1Prefix[0]:
+		if prefix, err := c.r.Peek(len(proxyV1Prefix)); err == nil && bytes.Equal(prefix, proxyV1Prefix) {
+			return c.readV1Header()
+		}
+	case proxyV2Sig[0]:
+		if sig, err := c.r.Peek(len(proxyV2Sig)); err == nil && bytes.Equal(sig, proxyV2Sig) {
+			return c.readV2Header()
+		}
+	}
+
+	if required {
+		return ErrInvalidProxyHeader
+	}
+	return nil
+}
+
+// Parses "PROXY TCP4|TCP6|UNKNOWN <src> <dst> <sport> <dport>\r\n"
+func (c *proxyConn) readV1Header() error {
+	var line []byte
+	for {
+		b, err := c.r.ReadByte()
+		if err != nil {
+			return err
+		}
+		line = append(line, b)
+		if b == '\n' {
+			break
+		}
+		if len(line) >= proxyV1MaxLine {
+			return ErrInvalidProxyHeader
+		}
+	}
+
+	if !bytes.HasSuffix(line, []byte("\r\n")) {
+		return ErrInvalidProxyHeader
+	}
+	fields := strings.Fields(string(line[:len(line)-2]))
+	if len(fields) < 2 {
+		return ErrInvalidProxyHeader
+	}
+
+	switch fields[1] {
+	case "UNKNOWN":
+		return nil
+	case "TCP4", "TCP6":
+	default:
+		return ErrInvalidProxyHeader
+	}
+	if len(fields) != 6 {
+		return ErrInvalidProxyHeader
+	}
+
+	src, err := parseProxyV1Addr(fields[2], fields[4])
+	if err != nil {
+		return err
+	}
+	dst, err := parseProxyV1Addr(fields[3], fields[5])
+	if err != nil {
+		return err
+	}
+	if (fields[1] == "TCP4") != (src.IP.To4() != nil && dst.IP.To4() != nil) {
+		return ErrInvalidProxyHeader
+	}
+
+	c.remoteAddr, c.localAddr = src, dst
+	return nil
+}
+
+func parseProxyV1Addr(ip, port string) (*net.TCPAddr, error) {
+	addr := &net.TCPAddr{IP: net.ParseIP(ip)}
+	if addr.IP == nil {
+		return nil, ErrInvalidProxyHeader
+	}
+	p, err := strconv.ParseUint(port, 10, 16)
+	if err != nil {
+		return nil, ErrInvalidProxyHeader
+	}
+	addr.Port = int(p)
+	return addr, nil
+}
+
+// Parses the binary v2 header
+func (c *proxyConn) readV2Header() error {
+	var header [16]byte
+	if _, err := io.ReadFull(c.r, header[:]); err != nil {
+		return err
+	}
+
+	if header[12]>>4 != 2 {
+		return fmt.Errorf("%w: unsupported version %d", ErrInvalidProxyHeader, header[12]>>4)
+	}
+	command := header[12] & 0x0f
+	family := header[13] >> 4
+	transport := header[13] & 0x0f
+	length := int(binary.BigEndian.Uint16(header[14:16]))
+
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(c.r, payload); err != nil {
+		return unexpectedEOF(err)
+	}
+
+	switch command {
+	case 0x0: // LOCAL: health checks etc. by the proxy itself
+		return nil
+	case 0x1: // PROXY
+	default:
+		return ErrInvalidProxyHeader
+	}
+
+	// only TCP over IPv4/IPv6 carries addresses we are interested in
+	if transport != 0x1 {
+		return nil
+	}
+
+	switch family {
+	case 0x1: // AF_INET
+		if length < 12 {
+			return ErrInvalidProxyHeader
+		}
+		c.remoteAddr = &net.TCPAddr{IP: net.IP(payload[0:4]), Port: int(binary.BigEndian.Uint16(payload[8:10]))}
+		c.localAddr = &net.TCPAddr{IP: net.IP(payload[4:8]), Port: int(binary.BigEndian.Uint16(payload[10:12]))}
+	case 0x2: // AF_INET6
+		if length < 36 {
+			return ErrInvalidProxyHeader
+		}
+		c.remoteAddr = &net.TCPAddr{IP: net.IP(payload[0:16]), Port: int(binary.BigEndian.Uint16(payload[32:34]))}
+		c.localAddr = &net.TCPAddr{IP: net.IP(payload[16:32]), Port: int(binary.BigEndian.Uint16(payload[34:36]))}
+	}
+	return nil
+}
@@ -0,0 +1,212 @@
+package tcpserver
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// Runs header through wrapConn on an in-memory connection from 127.0.0.1
+// and returns the wrapped connection's client address and remaining data;
+// a nil header sends nothing and keeps the connection open
+func wrapProxyConn(t *testing.T, config *ProxyProtocolConfig, header []byte) (string, []byte, error) {
+	t.Helper()
+
+	s, _ := NewServer("127.0.0.1:0")
+	if err := s.SetProxyProtocol(config); err != nil {
+		t.Fatalf("error setting PROXY protocol config: %s", err)
+	}
+
+	client, server := net.Pipe()
+	defer client.Close()
+	netConn := &pipeConn{
+		Conn:       server,
+		localAddr:  &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 80},
+		remoteAddr: &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1234},
+	}
+	defer netConn.Close()
+
+	if header != nil {
+		go func() {
+			client.Write(header)
+			client.Close()
+		}()
+	}
+
+	conn, err := s.proxyProtocol.wrapConn(netConn)
+	if err != nil {
+		return "", nil, err
+	}
+	if header == nil {
+		return conn.RemoteAddr().String(), nil, nil
+	}
+
+	rest, _ := io.ReadAll(conn)
+	return conn.RemoteAddr().String(), rest, nil
+}
+
+func TestProxyProtocolHeaders(t *testing.T) {
+	t.Parallel()
+
+	v2 := func(family byte, addrs ...byte) []byte {
+		h := append([]byte("\r\n\r\n\x00\r\nQUIT\n"), 0x21, family, 0, byte(len(addrs)))
+		return append(h, addrs...)
+	}
+	v6 := append(append(net.ParseIP("2001:db8::1").To16(), net.ParseIP("2001:db8::2").To16()...), 0x1F, 0x90, 0, 80)
+
+	tests := []struct {
+		name   string
+		header []byte
+		addr   string
+	}{
+		{"v1 tcp4", []byte("PROXY TCP4 1.2.3.4 5.6.7.8 1111 2222\r\n"), "1.2.3.4:1111"},
+		{"v1 tcp6", []byte("PROXY TCP6 2001:db8::1 2001:db8::2 8080 80\r\n"), "[2001:db8::1]:8080"},
+		{"v1 unknown", []byte("PROXY UNKNOWN\r\n"), "127.0.0.1:1234"},
+		{"v2 tcp4", v2(0x11, 9, 9, 9, 9, 1, 1, 1, 1, 0, 80, 0, 81), "9.9.9.9:80"},
+		{"v2 tcp6", v2(0x21, v6...), "[2001:db8::1]:8080"},
+		{"v2 unspec", v2(0x00), "127.0.0.1:1234"},
+		{"no header", nil, "127.0.0.1:1234"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			payload := []byte("hello")
+			addr, rest, err := wrapProxyConn(t, &ProxyProtocolConfig{TrustAll: true}, append(tt.header, payload...))
+			if err != nil {
+				t.Fatalf("error reading header: %s", err)
+			}
+			if addr != tt.addr {
+				t.Fatalf("got client address %s, want %s", addr, tt.addr)
+			}
+			if !bytes.Equal(rest, payload) {
+				t.Fatalf("got payload %q, want %q", rest, payload)
+			}
+		})
+	}
+}
+
+func TestProxyProtocolInvalidHeaders(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name   string
+		header string
+	}{
+		{"missing", "hello"},
+		{"v1 garbage", "PROXY TCP4 nonsense\r\n"},
+		{"v1 bad port", "PROXY TCP4 1.2.3.4 5.6.7.8 99999 2222\r\n"},
+		{"v1 family mismatch", "PROXY TCP4 2001:db8::1 5.6.7.8 1111 2222\r\n"},
+		{"v2 bad version", "\r\n\r\n\x00\r\nQUIT\n\x11\x11\x00\x00"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			config := &ProxyProtocolConfig{TrustAll: true, Required: true, HeaderTimeout: time.Second}
+			if _, _, err := wrapProxyConn(t, config, []byte(tt.header)); err == nil {
+				t.Fatalf("expected error for header %q", tt.header)
+			}
+		})
+	}
+}
+
+func TestProxyProtocolOptionalTimeout(t *testing.T) {
+	t.Parallel()
+
+	// a client that sends nothing is served as is
+	config := &ProxyProtocolConfig{TrustAll: true, HeaderTimeout: 50 * time.Millisecond}
+	addr, _, err := wrapProxyConn(t, config, nil)
+	if err != nil {
+		t.Fatalf("error waiting for optional header: %s", err)
+	}
+	if addr != "127.0.0.1:1234" {
+		t.Fatalf("got client address %s, want 127.0.0.1:1234", addr)
+	}
+
+	config.Required = true
+	var netErr net.Error
+	if _, _, err := wrapProxyConn(t, config, nil); !errors.As(err, &netErr) || !netErr.Timeout() {
+		t.Fatalf("got %v, want timeout error", err)
+	}
+}
+
+func TestProxyProtocolTrustedProxies(t *testing.T) {
+	t.Parallel()
+
+	s, _ := NewServer("127.0.0.1:0")
+	if err := s.SetProxyProtocol(&ProxyProtocolConfig{}); err == nil {
+		t.Fatal("expected error for empty trusted proxies")
+	}
+
+	// the header from an untrusted peer is left untouched
+	header := []byte("PROXY TCP4 1.2.3.4 5.6.7.8 1111 2222\r\n")
+	addr, rest, err := wrapProxyConn(t, &ProxyProtocolConfig{TrustedProxies: []string{"10.0.0.0/8"}}, header)
+	if err != nil {
+		t.Fatalf("error wrapping untrusted connection: %s", err)
+	}
+	if addr != "127.0.0.1:1234" || !bytes.Equal(rest, header) {
+		t.Fatalf("got %s %q, want untouched connection", addr, rest)
+	}
+}
+
+func TestProxyProtocolFilterAndLimits(t *testing.T) {
+	t.Parallel()
+
+	// both act on the original clients, not on the proxy (127.0.0.1)
+	ts := NewTestServer(echoHandler)
+	defer ts.Close()
+	if err := ts.SetProxyProtocol(&ProxyProtocolConfig{TrustAll: true}); err != nil {
+		t.Fatal(err)
+	}
+	filter, err := NewIPFilter([]string{"1.2.3.0/24"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts.SetIPFilter(filter)
+	ts.SetLimits(&Limits{MaxConnectionsPerIP: 1})
+
+	dial := func(client string) net.Conn {
+		conn, err := ts.Dial()
+		if err != nil {
+			t.Fatal(err)
+		}
+		header := "PROXY TCP4 " + client + " 127.0.0.1 1111 80\r\nping"
+		if _, err := conn.Write([]byte(header)); err != nil {
+			t.Fatal(err)
+		}
+		return conn
+	}
+	served := func(conn net.Conn) bool {
+		_ = conn.SetReadDeadline(time.Now().Add(time.Second))
+		_, err := io.ReadFull(conn, make([]byte, 4))
+		return err == nil
+	}
+
+	first := dial("1.2.3.4")
+	defer first.Close()
+	second := dial("1.2.3.5")
+	defer second.Close()
+	if !served(first) || !served(second) {
+		t.Fatal("proxied clients not served")
+	}
+
+	denied := dial("5.6.7.8")
+	defer denied.Close()
+	if served(denied) {
+		t.Fatal("client denied by IP filter served")
+	}
+	limited := dial("1.2.3.4")
+	defer limited.Close()
+	if served(limited) {
+		t.Fatal("client exceeding MaxConnectionsPerIP served")
+	}
+	if ts.GetDeniedConnections() != 1 || ts.GetRejectedConnections() != 1 {
+		t.Fatalf("got %d denied and %d rejected connections, want 1 each", ts.GetDeniedConnections(), ts.GetRejectedConnections())
+	}
+}
@@ -0,0 +1,53 @@
+package tcpserver
+
+import (
+	"time"
+)
+
+// Simple token bucket; not safe for concurrent use
+type tokenBucket struct {
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+// Creates a full token bucket refilled with rate tokens per second holding
+// at most burst tokens (at least 1)
+func newTokenBucket(rate float64, burst int) *tokenBucket {
+	if burst < 1 {
+		burst = 1
+	}
+	return &tokenBucket{
+		rate:   rate,
+		burst:  float64(burst),
+		tokens: float64(burst),
+		last:   time.Now(),
+	}
+}
+
+func (b *tokenBucket) refill(now time.Time) {
+	if elapsed := now.Sub(b.last).Seconds(); elapsed > 0 {
+		b.tokens += elapsed * b.rate
+		if b.tokens > b.burst {
+			b.tokens = b.burst
+		}
+	}
+	b.last = now
+}
+
+// Takes n tokens if available
+func (b *tokenBucket) allow(now time.Time, n float64) bool {
+	b.refill(now)
+	if b.tokens < n {
+		return false
+	}
+	b.tokens -= n
+	return true
+}
+
+// Returns whether the bucket has been refilled completely
+func (b *tokenBucket) isFull(now time.Time) bool {
+	b.refill(now)
+	return b.tokens >= b.burst
+}
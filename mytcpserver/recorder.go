@@ -0,0 +1,181 @@
+package tcpserver
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Magic at the start of every recording file
+const recordingMagic = "TCPREC1"
+
+const (
+	// Data read from the peer
+	DirectionRead byte = 'R'
+	// Data written to the peer
+	DirectionWrite byte = 'W'
+)
+
+// Records both directions of selected connections (by client IP or
+// connection key) into files, one per connection. Recordings can be
+// replayed using Replay().
+type Recorder struct {
+	dir  string
+	mu   sync.RWMutex
+	ips  *IPFilter
+	keys map[string]bool
+}
+
+// Creates a new recorder writing recordings to dir
+func NewRecorder(dir string) *Recorder {
+	return &Recorder{
+		dir:  dir,
+		keys: make(map[string]bool),
+	}
+}
+
+// Records connections from given client IPs or CIDRs
+func (r *Recorder) RecordIPs(cidrs ...string) error {
+	ips, err := NewIPFilter(cidrs, nil)
+	if err != nil {
+		return err
+	}
+	r.mu.Lock()
+	if r.ips != nil {
+		ips.allow = append(r.ips.allow, ips.allow...)
+	}
+	r.ips = ips
+	r.mu.Unlock()
+	return nil
+}
+
+// Records connections with given keys (see connection.SetKey()); recording
+// starts as soon as the key is assigned
+func (r *Recorder) RecordKeys(keys ...string) {
+	r.mu.Lock()
+	for _, key := range keys {
+		r.keys[key] = true
+	}
+	r.mu.Unlock()
+}
+
+// Stops recording all IPs and keys (running recordings are continued)
+func (r *Recorder) Reset() {
+	r.mu.Lock()
+	r.ips = nil
+	r.keys = make(map[string]bool)
+	r.mu.Unlock()
+}
+
+func (r *Recorder) matchAddr(addr *net.TCPAddr) bool {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return addr != nil && r.ips != nil && len(r.ips.allow) > 0 && r.ips.AllowedAddr(addr)
+}
+
+func (r *Recorder) matchKey(key string) bool {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return key != "" && r.keys[key]
+}
+
+// Sets session recorder (nil disables recording of new connections)
+func (s *Server) SetRecorder(r *Recorder) {
+	s.recorder.Store(r)
+}
+
+// Single connection's recording file
+type sessionRecording struct {
+	mu   sync.Mutex
+	f    *os.File
+	w    *bufio.Writer
+	err  error
+	hdr  [13]byte
+	done bool
+}
+
+// Placeholder for finished recordings; keeps recordings from being started
+// after the connection has been finished
+var recordingStopped = &sessionRecording{done: true}
+
+// Starts recording the connection if the recorder selects it by client
+// address or by given key
+func (conn *TCPConn) startRecording(key string) {
+	s := conn.server
+	if s == nil || conn.recording.Load() != nil {
+		return
+	}
+	r := s.recorder.Load()
+	if r == nil || !(r.matchAddr(conn.GetClientAddr()) || r.matchKey(key)) {
+		return
+	}
+
+	name := fmt.Sprintf("%s-%d-%s.rec", time.Now().Format("20060102-150405"), conn.id,
+		strings.NewReplacer(":", "_", "/", "_", "[", "", "]", "").Replace(fmt.Sprint(conn.RemoteAddr())))
+	// recordings may contain decrypted TLS payloads
+	f, err := os.OpenFile(filepath.Join(r.dir, name), os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+	if err != nil {
+		s.logf("tcpserver: error creating recording for connection %d: %s", conn.id, err)
+		return
+	}
+
+	rec := &sessionRecording{f: f, w: bufio.NewWriter(f)}
+	// addresses are quoted as they may be empty (e.g. Unix domain socket peers)
+	fmt.Fprintf(rec.w, "%s %q %q\n", recordingMagic, conn.RemoteAddr().String(), conn.LocalAddr().String())
+	if !conn.recording.CompareAndSwap(nil, rec) {
+		f.Close()
+		os.Remove(f.Name())
+	}
+}
+
+// Adds data to the connection's recording (if any)
+func (conn *TCPConn) record(direction byte, b []byte) {
+	if rec := conn.recording.Load(); rec != nil && rec != recordingStopped {
+		rec.write(direction, b)
+	}
+}
+
+// Finishes the connection's recording (if any)
+func (conn *TCPConn) stopRecording() {
+	if rec := conn.recording.Swap(recordingStopped); rec != nil && rec != recordingStopped {
+		if err := rec.close(); err != nil && conn.server != nil {
+			conn.server.logf("tcpserver: error writing recording for connection %d: %s", conn.id, err)
+		}
+	}
+}
+
+// Writes a record: direction (1 byte), unix nano timestamp (8 bytes),
+// length (4 bytes), data
+func (rec *sessionRecording) write(direction byte, b []byte) {
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	if rec.done || rec.err != nil {
+		return
+	}
+
+	rec.hdr[0] = direction
+	binary.BigEndian.PutUint64(rec.hdr[1:9], uint64(time.Now().UnixNano()))
+	binary.BigEndian.PutUint32(rec.hdr[9:13], uint32(len(b)))
+	if _, rec.err = rec.w.Write(rec.hdr[:]); rec.err == nil {
+		_, rec.err = rec.w.Write(b)
+	}
+}
+
+func (rec *sessionRecording) close() error {
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	rec.done = true
+	if rec.err == nil {
+		rec.err = rec.w.Flush()
+	}
+	if err := rec.f.Close(); rec.err == nil {
+		rec.err = err
+	}
+	return rec.err
+}
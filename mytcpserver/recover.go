@@ -0,0 +1,64 @@
+package tcpserver
+
+import (
+	"fmt"
+	"log"
+	"runtime/debug"
+)
+
+// Request handler function type returning an error; errors are passed to
+// the error hook (see SetOnError())
+type RequestHandlerErrFunc func(conn Connection) error
+
+// Error passed to the error hook when a request handler panics
+type PanicError struct {
+	Value interface{}
+	Stack []byte
+}
+
+func (e *PanicError) Error() string {
+	return fmt.Sprintf("tcpserver: panic in request handler: %v", e.Value)
+}
+
+// Sets request handler function that returns an error
+func (s *Server) SetRequestHandlerErr(f RequestHandlerErrFunc) {
+	s.requestHandler = func(conn Connection) {
+		if err := f(conn); err != nil {
+			conn.(*TCPConn).setCloseReason(CloseReasonError)
+			s.errorHook(conn, err)
+		}
+	}
+}
+
+// Sets logger used for panics in request handlers (defaults to the
+// standard logger)
+func (s *Server) SetErrorLog(l *log.Logger) {
+	s.errorLog = l
+}
+
+// Completes connection setup and runs the request handler; recovers from
+// panics so that a single faulty handler does not crash the server
+func (s *Server) runHandler(conn *TCPConn) {
+	defer func() {
+		if v := recover(); v != nil {
+			err := &PanicError{Value: v, Stack: debug.Stack()}
+			conn.setCloseReason(CloseReasonPanic)
+			s.logf("tcpserver: panic serving connection %d (%s): %v\n%s", conn.id, conn.RemoteAddr(), v, err.Stack)
+			s.errorHook(conn, err)
+		}
+	}()
+
+	if err := s.connectConn(conn); err != nil {
+		s.errorHook(conn, err)
+		return
+	}
+	s.requestHandler(conn)
+}
+
+func (s *Server) logf(format string, args ...interface{}) {
+	if s.errorLog != nil {
+		s.errorLog.Printf(format, args...)
+	} else {
+		log.Printf(format, args...)
+	}
+}
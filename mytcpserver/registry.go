@@ -0,0 +1,211 @@
+package tcpserver
+
+import (
+	"errors"
+	"sort"
+)
+
+// Returned when no live connection matches a given ID or key
+var ErrConnectionNotFound = errors.New("tcpserver: connection not found")
+
+// Adds connection to (or removes it from) the registry of live connections.
+// Connections added after closeConnections() has been called are closed
+// right away. When removing, returns whether the connection struct may be
+// reused (i.e. it is neither pinned nor has been handed out); the connection
+// leaves all groups at the same time so that it cannot rejoin any.
+func (s *Server) trackConn(conn *TCPConn, add bool) (reusable bool) {
+	s.connsMu.Lock()
+	defer s.connsMu.Unlock()
+	if add {
+		s.conns[conn.id] = conn
+		if s.connsClosed {
+			conn.setCloseReason(CloseReasonShutdown)
+			_ = conn.Conn.Close()
+		}
+		return false
+	}
+
+	delete(s.conns, conn.id)
+	if conn.key != "" && s.connsByKey[conn.key] == conn {
+		delete(s.connsByKey, conn.key)
+	}
+	s.leaveAllGroups(conn)
+	conn.retired = true
+	return conn.pins == 0 && !conn.published
+}
+
+// Pins the connection if it is still live with given ID so that its struct
+// is not reused for another connection before unpinConn() is called.
+// Returns false if the connection is gone (and probably already reused).
+// Pins, published and retired flags of a connection are guarded by connsMu.
+func (s *Server) pinConn(conn *TCPConn, id uint64) bool {
+	s.connsMu.Lock()
+	defer s.connsMu.Unlock()
+	if s.conns[id] != conn {
+		return false
+	}
+	conn.pins++
+	return true
+}
+
+// Releases a pin and returns the connection struct to the pool if the
+// connection has been finished meanwhile
+func (s *Server) unpinConn(conn *TCPConn) {
+	s.connsMu.Lock()
+	conn.pins--
+	reusable := conn.pins == 0 && conn.retired && !conn.published
+	s.connsMu.Unlock()
+
+	if reusable {
+		s.connStructPool.Put(conn)
+	}
+}
+
+// Returns pinned live connections (ordered by connection ID); each one has
+// to be released using unpinConn()
+func (s *Server) pinConns() []*TCPConn {
+	s.connsMu.Lock()
+	conns := make([]*TCPConn, 0, len(s.conns))
+	for _, conn := range s.conns {
+		conn.pins++
+		conns = append(conns, conn)
+	}
+	s.connsMu.Unlock()
+
+	sort.Slice(conns, func(i, j int) bool {
+		return conns[i].id < conns[j].id
+	})
+	return conns
+}
+
+// Forcibly closes all live connections and returns how many were closed
+func (s *Server) closeConnections() int {
+	s.connsMu.Lock()
+	defer s.connsMu.Unlock()
+	s.connsClosed = true
+	for _, conn := range s.conns {
+		conn.setCloseReason(CloseReasonShutdown)
+		_ = conn.Conn.Close()
+	}
+	return len(s.conns)
+}
+
+// Returns live connection with given ID or nil.
+// Connections handed out by the registry are never reused for other
+// connections, so a handle kept after the peer has disconnected refers to
+// the closed connection (see also SendTo() and Kick()).
+func (s *Server) GetConnection(id uint64) Connection {
+	s.connsMu.Lock()
+	defer s.connsMu.Unlock()
+	if conn, ok := s.conns[id]; ok {
+		conn.published = true
+		return conn
+	}
+	return nil
+}
+
+// Returns live connection with given user-assigned key (see
+// Connection.SetKey()) or nil
+func (s *Server) GetConnectionByKey(key string) Connection {
+	s.connsMu.Lock()
+	defer s.connsMu.Unlock()
+	if conn, ok := s.connsByKey[key]; ok {
+		conn.published = true
+		return conn
+	}
+	return nil
+}
+
+// Calls f for each live connection (ordered by connection ID) until f
+// returns false. The registry is not locked while f is running.
+func (s *Server) RangeConnections(f func(conn Connection) bool) {
+	conns := s.pinConns()
+	s.connsMu.Lock()
+	for _, conn := range conns {
+		conn.published = true
+	}
+	s.connsMu.Unlock()
+	defer func() {
+		for _, conn := range conns {
+			s.unpinConn(conn)
+		}
+	}()
+
+	for _, conn := range conns {
+		if !f(conn) {
+			return
+		}
+	}
+}
+
+// Pins the live connection with given key (see pinConn())
+func (s *Server) pinConnByKey(key string) *TCPConn {
+	s.connsMu.Lock()
+	defer s.connsMu.Unlock()
+	conn, ok := s.connsByKey[key]
+	if !ok {
+		return nil
+	}
+	conn.pins++
+	return conn
+}
+
+// Writes data to the connection with given key
+func (s *Server) SendTo(key string, data []byte) (int, error) {
+	conn := s.pinConnByKey(key)
+	if conn == nil {
+		return 0, ErrConnectionNotFound
+	}
+	defer s.unpinConn(conn)
+	return conn.Write(data)
+}
+
+// Closes the connection with given key
+func (s *Server) Kick(key string) error {
+	conn := s.pinConnByKey(key)
+	if conn == nil {
+		return ErrConnectionNotFound
+	}
+	defer s.unpinConn(conn)
+	conn.setCloseReason(CloseReasonKicked)
+	return conn.GetNetConn().Close()
+}
+
+// Returns user-assigned key
+func (conn *TCPConn) GetKey() string {
+	if s := conn.server; s != nil {
+		s.connsMu.Lock()
+		defer s.connsMu.Unlock()
+	}
+	return conn.key
+}
+
+// Assigns a key (e.g. a device serial) to the connection that can be used
+// to look it up using server.GetConnectionByKey(). If another connection
+// already uses the same key, it loses the key. An empty key removes the
+// connection from the key index.
+func (conn *TCPConn) SetKey(key string) {
+	s := conn.server
+	if s == nil {
+		conn.key = key
+		return
+	}
+
+	s.connsMu.Lock()
+	if conn.key != "" && s.connsByKey[conn.key] == conn {
+		delete(s.connsByKey, conn.key)
+	}
+	conn.key = key
+	_, live := s.conns[conn.id]
+	if key == "" || !live {
+		s.connsMu.Unlock()
+		return
+	}
+	if prev, ok := s.connsByKey[key]; ok && prev != conn {
+		prev.key = ""
+	}
+	s.connsByKey[key] = conn
+	s.connsMu.Unlock()
+
+	conn.startRecording(key)
+}
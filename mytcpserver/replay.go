@@ -0,0 +1,192 @@
+package tcpserver
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Single record of a session recording
+type RecordEntry struct {
+	// Either DirectionRead (data sent by the client) or DirectionWrite
+	// (data sent by the server)
+	Direction byte
+	Time      time.Time
+	Data      []byte
+}
+
+// Session recording
+type Recording struct {
+	ClientAddr string
+	ServerAddr string
+	Entries    []RecordEntry
+}
+
+// Reads a recording file written by Recorder
+func ReadRecording(path string) (*Recording, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	r := bufio.NewReader(f)
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return nil, fmt.Errorf("error reading recording header: %s", err)
+	}
+	addrs, ok := strings.CutPrefix(strings.TrimSuffix(line, "\n"), recordingMagic+" ")
+	if !ok {
+		return nil, fmt.Errorf("invalid recording header")
+	}
+	clientAddr, addrs, err := unquoteField(addrs)
+	if err != nil {
+		return nil, err
+	}
+	serverAddr, addrs, err := unquoteField(addrs)
+	if err != nil || addrs != "" {
+		return nil, fmt.Errorf("invalid recording header")
+	}
+
+	rec := &Recording{ClientAddr: clientAddr, ServerAddr: serverAddr}
+	var hdr [13]byte
+	for {
+		if _, err := io.ReadFull(r, hdr[:]); err != nil {
+			if err == io.EOF {
+				return rec, nil
+			}
+			return nil, err
+		}
+		data := make([]byte, binary.BigEndian.Uint32(hdr[9:13]))
+		if _, err := io.ReadFull(r, data); err != nil {
+			return nil, unexpectedEOF(err)
+		}
+		ts := int64(binary.BigEndian.Uint64(hdr[1:9]))
+		rec.Entries = append(rec.Entries, RecordEntry{
+			Direction: hdr[0],
+			Time:      time.Unix(ts/1e9, ts%1e9),
+			Data:      data,
+		})
+	}
+}
+
+// Returns the leading quoted string of s and the rest after a separating space
+func unquoteField(s string) (field string, rest string, err error) {
+	quoted, err := strconv.QuotedPrefix(s)
+	if err != nil {
+		return "", "", fmt.Errorf("invalid recording header")
+	}
+	if field, err = strconv.Unquote(quoted); err != nil {
+		return "", "", fmt.Errorf("invalid recording header")
+	}
+	return field, strings.TrimPrefix(s[len(quoted):], " "), nil
+}
+
+// Feeds the client data of a recording into handler through an in-memory
+// connection and returns everything the handler has written. With realtime
+// enabled, the original delays between client writes are reproduced.
+func Replay(path string, handler RequestHandlerFunc, realtime bool) ([]byte, error) {
+	rec, err := ReadRecording(path)
+	if err != nil {
+		return nil, err
+	}
+	return rec.Replay(handler, realtime)
+}
+
+// Feeds the client data into handler; see Replay()
+func (rec *Recording) Replay(handler RequestHandlerFunc, realtime bool) ([]byte, error) {
+	pr, pw := io.Pipe()
+	mc := &memConn{
+		r:          pr,
+		remoteAddr: replayAddr(rec.ClientAddr),
+		localAddr:  replayAddr(rec.ServerAddr),
+	}
+
+	conn := &TCPConn{}
+	conn.Reset(mc)
+	conn.Start()
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		handler(conn)
+		conn.Close()
+	}()
+
+	var last time.Time
+	for _, entry := range rec.Entries {
+		if entry.Direction != DirectionRead {
+			continue
+		}
+		if realtime && !last.IsZero() {
+			time.Sleep(entry.Time.Sub(last))
+		}
+		last = entry.Time
+		if _, err := pw.Write(entry.Data); err != nil {
+			// handler stopped reading
+			break
+		}
+	}
+	pw.Close()
+	<-done
+
+	return mc.output(), nil
+}
+
+// Resolves a recorded address; falls back to a non-TCP address
+func replayAddr(addr string) net.Addr {
+	if tcpAddr, err := net.ResolveTCPAddr("tcp", addr); err == nil {
+		return tcpAddr
+	}
+	return &net.UnixAddr{Name: addr, Net: "unix"}
+}
+
+// In-memory connection reading from a pipe and writing into a buffer
+type memConn struct {
+	r          *io.PipeReader
+	mu         sync.Mutex
+	buf        bytes.Buffer
+	closed     bool
+	remoteAddr net.Addr
+	localAddr  net.Addr
+}
+
+func (c *memConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+func (c *memConn) Write(b []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return 0, net.ErrClosed
+	}
+	return c.buf.Write(b)
+}
+
+func (c *memConn) Close() error {
+	c.mu.Lock()
+	c.closed = true
+	c.mu.Unlock()
+	return c.r.CloseWithError(net.ErrClosed)
+}
+
+func (c *memConn) output() []byte {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]byte(nil), c.buf.Bytes()...)
+}
+
+func (c *memConn) LocalAddr() net.Addr                { return c.localAddr }
+func (c *memConn) RemoteAddr() net.Addr               { return c.remoteAddr }
+func (c *memConn) SetDeadline(t time.Time) error      { return nil }
+func (c *memConn) SetReadDeadline(t time.Time) error  { return nil }
+func (c *memConn) SetWriteDeadline(t time.Time) error { return nil }
@@ -0,0 +1,216 @@
+package tcpserver
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+)
+
+// Returned by the default unknown command handler
+var ErrUnknownCommand = errors.New("tcpserver: unknown command")
+
+// Extracts the message type/command code from a frame (usually from its header)
+type CommandExtractorFunc func(frame []byte) (cmd uint32, err error)
+
+// Message handler function type used by Router
+type MessageHandlerFunc func(req *Request) error
+
+// Middleware wraps a message handler
+type MiddlewareFunc func(next MessageHandlerFunc) MessageHandlerFunc
+
+// Router error handler; returning nil keeps the connection open, returning
+// an error closes it
+type RouterErrorHandlerFunc func(req *Request, err error) error
+
+// A single framed request dispatched by Router
+type Request struct {
+	Conn    Connection
+	Framer  *Framer
+	Command uint32
+	Frame   []byte
+}
+
+// Returns the connection's context
+func (req *Request) Context() context.Context {
+	return *req.Conn.GetContext()
+}
+
+// Writes a response frame back to the peer
+func (req *Request) Reply(frame []byte) error {
+	return req.Framer.WriteFrame(frame)
+}
+
+// Router dispatches frames to handlers registered per command code
+type Router struct {
+	codec            Codec
+	commandExtractor CommandExtractorFunc
+	handlers         map[uint32]MessageHandlerFunc
+	middleware       []MiddlewareFunc
+	notFoundHandler  MessageHandlerFunc
+	errorHandler     RouterErrorHandlerFunc
+	maxFrameSize     int
+	mu               sync.RWMutex
+}
+
+// Creates a new router reading frames using codec and extracting the
+// command code using extractor
+func NewRouter(codec Codec, extractor CommandExtractorFunc) *Router {
+	return &Router{
+		codec:            codec,
+		commandExtractor: extractor,
+		handlers:         make(map[uint32]MessageHandlerFunc),
+		maxFrameSize:     DefaultMaxFrameSize,
+	}
+}
+
+// Registers handler for given command code
+func (r *Router) Handle(cmd uint32, handler MessageHandlerFunc) {
+	r.mu.Lock()
+	r.handlers[cmd] = handler
+	r.mu.Unlock()
+}
+
+// Adds middleware; middleware is applied in the order it was added and
+// also wraps the unknown command handler
+func (r *Router) Use(middleware ...MiddlewareFunc) {
+	r.mu.Lock()
+	r.middleware = append(r.middleware, middleware...)
+	r.mu.Unlock()
+}
+
+// Sets handler for unknown commands (defaults to returning ErrUnknownCommand)
+func (r *Router) SetNotFoundHandler(handler MessageHandlerFunc) {
+	r.mu.Lock()
+	r.notFoundHandler = handler
+	r.mu.Unlock()
+}
+
+// Sets error handler that is called for errors returned by handlers or the
+// command extractor (by default any error closes the connection). Errors
+// reading frames (e.g. ErrFrameTooLarge) are passed as well (with a nil
+// Frame) but always close the connection.
+func (r *Router) SetErrorHandler(handler RouterErrorHandlerFunc) {
+	r.mu.Lock()
+	r.errorHandler = handler
+	r.mu.Unlock()
+}
+
+// Sets maximum frame size
+func (r *Router) SetMaxFrameSize(size int) {
+	r.maxFrameSize = size
+}
+
+// Serves a connection; use as request handler: server.SetRequestHandler(router.ServeConn)
+func (r *Router) ServeConn(conn Connection) {
+	_ = r.ServeConnErr(conn)
+}
+
+// Serves a connection and returns the error that closed it (nil if the peer
+// disconnected); use as request handler to pass such errors to the server's
+// error hook: server.SetRequestHandlerErr(router.ServeConnErr)
+func (r *Router) ServeConnErr(conn Connection) error {
+	framer := NewFramer(conn, r.codec)
+	framer.SetMaxFrameSize(r.maxFrameSize)
+
+	for {
+		frame, err := framer.ReadFrame()
+		if err != nil {
+			if err == io.EOF || errors.Is(err, net.ErrClosed) || (*conn.GetContext()).Err() != nil {
+				return nil
+			}
+			req := &Request{
+				Conn:   conn,
+				Framer: framer,
+			}
+			if herr := r.handleError(req, err); herr != nil {
+				return herr
+			}
+			return err
+		}
+
+		req := &Request{
+			Conn:   conn,
+			Framer: framer,
+			Frame:  frame,
+		}
+
+		if err = r.dispatch(req); err != nil {
+			if err = r.handleError(req, err); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// Dispatches a single request to its handler
+func (r *Router) dispatch(req *Request) error {
+	cmd, err := r.commandExtractor(req.Frame)
+	if err != nil {
+		return err
+	}
+	req.Command = cmd
+
+	r.mu.RLock()
+	handler, ok := r.handlers[cmd]
+	if !ok {
+		handler = r.notFoundHandler
+		if handler == nil {
+			handler = defaultNotFoundHandler
+		}
+	}
+	for i := len(r.middleware) - 1; i >= 0; i-- {
+		handler = r.middleware[i](handler)
+	}
+	r.mu.RUnlock()
+
+	return handler(req)
+}
+
+func (r *Router) handleError(req *Request, err error) error {
+	r.mu.RLock()
+	errorHandler := r.errorHandler
+	r.mu.RUnlock()
+
+	if errorHandler == nil {
+		return err
+	}
+	return errorHandler(req, err)
+}
+
+func defaultNotFoundHandler(req *Request) error {
+	return fmt.Errorf("%w: 0x%x", ErrUnknownCommand, req.Command)
+}
+
+// Returns a command extractor that uses the byte at offset as command code
+func ByteCommand(offset int) CommandExtractorFunc {
+	return func(frame []byte) (uint32, error) {
+		if len(frame) < offset+1 {
+			return 0, ErrInvalidFrame
+		}
+		return uint32(frame[offset]), nil
+	}
+}
+
+// Returns a command extractor that uses the 16 bit integer at offset as command code
+func Uint16Command(offset int, order binary.ByteOrder) CommandExtractorFunc {
+	return func(frame []byte) (uint32, error) {
+		if len(frame) < offset+2 {
+			return 0, ErrInvalidFrame
+		}
+		return uint32(order.Uint16(frame[offset:])), nil
+	}
+}
+
+// Returns a command extractor that uses the 32 bit integer at offset as command code
+func Uint32Command(offset int, order binary.ByteOrder) CommandExtractorFunc {
+	return func(frame []byte) (uint32, error) {
+		if len(frame) < offset+4 {
+			return 0, ErrInvalidFrame
+		}
+		return order.Uint32(frame[offset:]), nil
+	}
+}
@@ -0,0 +1,205 @@
+package tcpserver
+
+import (
+	"errors"
+	"io"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Dials the test server and returns a framer for the client side
+func dialFramer(t *testing.T, ts *TestServer, codec Codec) *Framer {
+	t.Helper()
+
+	conn, err := ts.Dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		conn.Close()
+	})
+	return NewFramer(conn, codec)
+}
+
+// Sends frame and returns the response
+func roundTrip(t *testing.T, framer *Framer, frame string) string {
+	t.Helper()
+
+	if err := framer.WriteFrame([]byte(frame)); err != nil {
+		t.Fatal(err)
+	}
+	resp, err := framer.ReadFrame()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(resp)
+}
+
+func TestRouterMiddlewareOrder(t *testing.T) {
+	t.Parallel()
+
+	var (
+		mu    sync.Mutex
+		trace []string
+	)
+	record := func(s string) {
+		mu.Lock()
+		trace = append(trace, s)
+		mu.Unlock()
+	}
+	middleware := func(name string) MiddlewareFunc {
+		return func(next MessageHandlerFunc) MessageHandlerFunc {
+			return func(req *Request) error {
+				record(name + " before")
+				err := next(req)
+				record(name + " after")
+				return err
+			}
+		}
+	}
+
+	codec := NewLengthPrefixCodec(2)
+	router := NewRouter(codec, ByteCommand(0))
+	done := make(chan struct{})
+	router.Use(func(next MessageHandlerFunc) MessageHandlerFunc {
+		return func(req *Request) error {
+			defer close(done)
+			return next(req)
+		}
+	}, middleware("a"), middleware("b"))
+	router.Handle(1, func(req *Request) error {
+		record("handler")
+		return req.Reply([]byte("ok"))
+	})
+
+	ts := NewTestServer(router.ServeConn)
+	defer ts.Close()
+
+	if resp := roundTrip(t, dialFramer(t, ts, codec), "\x01"); resp != "ok" {
+		t.Fatalf("got %q, want %q", resp, "ok")
+	}
+
+	// the reply is written before the middleware returns
+	<-done
+	mu.Lock()
+	got := strings.Join(trace, ", ")
+	mu.Unlock()
+	want := "a before, b before, handler, b after, a after"
+	if got != want {
+		t.Fatalf("got %q, want %q", got, want)
+	}
+}
+
+func TestRouterNotFoundHandler(t *testing.T) {
+	t.Parallel()
+
+	codec := NewLengthPrefixCodec(2)
+	router := NewRouter(codec, ByteCommand(0))
+	router.Use(func(next MessageHandlerFunc) MessageHandlerFunc {
+		return func(req *Request) error {
+			if err := req.Reply([]byte("mw")); err != nil {
+				return err
+			}
+			return next(req)
+		}
+	})
+	router.SetNotFoundHandler(func(req *Request) error {
+		return req.Reply([]byte{'?', byte(req.Command)})
+	})
+
+	ts := NewTestServer(router.ServeConn)
+	defer ts.Close()
+
+	framer := dialFramer(t, ts, codec)
+	if resp := roundTrip(t, framer, "\x07"); resp != "mw" {
+		t.Fatalf("got %q, want middleware to wrap the not found handler", resp)
+	}
+	resp, err := framer.ReadFrame()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(resp) != "?\x07" {
+		t.Fatalf("got %q, want %q", resp, "?\x07")
+	}
+}
+
+func TestRouterErrorHandlerKeepsConnection(t *testing.T) {
+	t.Parallel()
+
+	errFailed := errors.New("failed")
+	codec := NewLengthPrefixCodec(2)
+	router := NewRouter(codec, ByteCommand(0))
+	router.Handle(1, func(req *Request) error {
+		return errFailed
+	})
+	router.Handle(2, func(req *Request) error {
+		return req.Reply([]byte("ok"))
+	})
+	router.SetErrorHandler(func(req *Request, err error) error {
+		if errors.Is(err, errFailed) {
+			return req.Reply([]byte("error"))
+		}
+		return err
+	})
+
+	ts := NewTestServer(router.ServeConn)
+	defer ts.Close()
+
+	framer := dialFramer(t, ts, codec)
+	if resp := roundTrip(t, framer, "\x01"); resp != "error" {
+		t.Fatalf("got %q, want %q", resp, "error")
+	}
+	if resp := roundTrip(t, framer, "\x02"); resp != "ok" {
+		t.Fatalf("got %q, want %q", resp, "ok")
+	}
+
+	// errors not handled close the connection
+	if err := framer.WriteFrame([]byte("")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := framer.ReadFrame(); !errors.Is(err, io.EOF) {
+		t.Fatalf("got %v, want EOF", err)
+	}
+}
+
+func TestRouterReadError(t *testing.T) {
+	t.Parallel()
+
+	routerErr := make(chan error, 1)
+	hookErr := make(chan error, 1)
+	codec := NewLengthPrefixCodec(2)
+	router := NewRouter(codec, ByteCommand(0))
+	router.SetMaxFrameSize(4)
+	router.SetErrorHandler(func(req *Request, err error) error {
+		routerErr <- err
+		// read errors close the connection anyway
+		return nil
+	})
+
+	ts := NewTestServer(nil)
+	ts.SetRequestHandlerErr(router.ServeConnErr)
+	ts.SetOnError(func(conn Connection, err error) {
+		hookErr <- err
+	})
+	defer ts.Close()
+
+	framer := dialFramer(t, ts, codec)
+	if err := framer.WriteFrame([]byte("\x01too large")); err != nil {
+		t.Fatal(err)
+	}
+	for _, ch := range []chan error{routerErr, hookErr} {
+		select {
+		case err := <-ch:
+			if !errors.Is(err, ErrFrameTooLarge) {
+				t.Fatalf("got %v, want ErrFrameTooLarge", err)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("read error not reported")
+		}
+	}
+	if _, err := framer.ReadFrame(); !errors.Is(err, io.EOF) {
+		t.Fatalf("got %v, want EOF", err)
+	}
+}
@@ -0,0 +1,66 @@
+package tcpserver
+
+import (
+	"net"
+)
+
+// Applies per-connection socket options of given listen config to an
+// accepted connection (no-op for non-TCP connections)
+func applyConnSocketOptions(conn net.Conn, config *ListenConfig) error {
+	tcpConn, ok := conn.(*net.TCPConn)
+	if !ok || config == nil {
+		return nil
+	}
+
+	if config.SocketKeepAliveIdle < 0 {
+		if err := tcpConn.SetKeepAlive(false); err != nil {
+			return err
+		}
+	} else if config.SocketKeepAliveIdle > 0 || config.SocketKeepAliveInterval > 0 || config.SocketKeepAliveCount > 0 {
+		err := tcpConn.SetKeepAliveConfig(net.KeepAliveConfig{
+			Enable:   true,
+			Idle:     config.SocketKeepAliveIdle,
+			Interval: config.SocketKeepAliveInterval,
+			Count:    config.SocketKeepAliveCount,
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	if config.SocketDisableNoDelay {
+		if err := tcpConn.SetNoDelay(false); err != nil {
+			return err
+		}
+	}
+
+	if config.SocketReadBuffer > 0 {
+		if err := tcpConn.SetReadBuffer(config.SocketReadBuffer); err != nil {
+			return err
+		}
+	}
+
+	if config.SocketWriteBuffer > 0 {
+		if err := tcpConn.SetWriteBuffer(config.SocketWriteBuffer); err != nil {
+			return err
+		}
+	}
+
+	if config.SocketLinger > 0 {
+		if err := tcpConn.SetLinger(config.SocketLinger); err != nil {
+			return err
+		}
+	} else if config.SocketLinger < 0 {
+		if err := tcpConn.SetLinger(0); err != nil {
+			return err
+		}
+	}
+
+	if config.SocketUserTimeout > 0 {
+		if err := setUserTimeout(tcpConn, config.SocketUserTimeout); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,29 @@
+//go:build linux
+
+package tcpserver
+
+import (
+	"net"
+	"syscall"
+	"time"
+)
+
+// TCP_USER_TIMEOUT (not defined in package syscall)
+const tcpUserTimeout = 0x12
+
+// Sets TCP_USER_TIMEOUT on given connection
+func setUserTimeout(conn *net.TCPConn, d time.Duration) error {
+	rawConn, err := conn.SyscallConn()
+	if err != nil {
+		return err
+	}
+
+	var sockErr error
+	err = rawConn.Control(func(fd uintptr) {
+		sockErr = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_TCP, tcpUserTimeout, int(d/time.Millisecond))
+	})
+	if err != nil {
+		return err
+	}
+	return sockErr
+}
@@ -0,0 +1,13 @@
+//go:build !linux
+
+package tcpserver
+
+import (
+	"net"
+	"time"
+)
+
+// TCP_USER_TIMEOUT is only supported on Linux
+func setUserTimeout(conn *net.TCPConn, d time.Duration) error {
+	return nil
+}
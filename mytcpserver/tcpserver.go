@@ -11,34 +11,80 @@
 package tcpserver
 
 import (
+	"bufio"
 	"context"
 	"crypto/tls"
+	"errors"
 	"fmt"
+	"io"
+	"log"
 	"net"
+	"os"
 	"runtime"
 	"sync"
 	"sync/atomic"
+	"syscall"
 	"time"
 
+	"gpk/listenfd"
+
 	"github.com/maurice2k/ultrapool"
 )
 
 // Server struct
 type Server struct {
-	listenAddr           *net.TCPAddr
-	listener             *net.TCPListener
-	shutdown             bool
-	shutdownDeadline     time.Time
+	listenAddrs          []net.Addr
+	listeners            []net.Listener
+	providedListeners    []net.Listener
+	shutdown             int32
+	serving              int32
 	requestHandler       RequestHandlerFunc
 	connectionCreator    ConnectionCreatorFunc
 	ctx                  *context.Context
+	baseCtx              context.Context
+	baseCancel           context.CancelFunc
+	ctxMu                sync.Mutex
+	lastConnID           uint64
+	readTimeout          time.Duration
+	writeTimeout         time.Duration
+	idleTimeout          time.Duration
 	activeConnections    int32
 	maxAcceptConnections int32
 	acceptedConnections  int32
+	rejectedConnections  int32
+	limiter              *limiter
+	ipFilter             atomic.Pointer[IPFilter]
+	deniedConnections    int32
+	proxyProtocol        *proxyProtocol
+	onAccept             AcceptHookFunc
+	onConnect            ConnectHookFunc
+	onClose              CloseHookFunc
+	onError              ErrorHookFunc
+	errorLog             *log.Logger
+	metrics              *metrics
+	identityAuthorizer   IdentityAuthorizerFunc
+	heartbeat            *HeartbeatConfig
+	throttling           int32
+	globalBandwidth      atomic.Pointer[bandwidthLimiter]
+	connBandwidth        atomic.Pointer[[2]*RateLimit]
+	groupBandwidth       map[string]*bandwidthLimiter
+	recorder             atomic.Pointer[Recorder]
 	tlsConfig            *tls.Config
 	tlsEnabled           bool
+	autoTLSEnabled       bool
+	mux                  *ProtocolMux
 	listenConfig         *ListenConfig
 	connWaitGroup        sync.WaitGroup
+	conns                map[uint64]*TCPConn
+	connsByKey           map[string]*TCPConn
+	connsMu              sync.Mutex
+	connsClosed          bool
+	groups               map[string]map[uint64]*TCPConn
+	groupsMu             sync.RWMutex
+	acceptLoopsDone      chan struct{}
+	shutdownDone         chan struct{}
+	shutdownOnce         sync.Once
+	killedConnections    int32
 	connStructPool       sync.Pool
 	loops                int
 	wp                   *ultrapool.WorkerPool
@@ -51,9 +97,20 @@ type Connection interface {
 	net.Conn
 	GetNetConn() net.Conn
 	GetServer() *Server
+	GetID() uint64
+	GetKey() string
+	SetKey(key string)
+	JoinGroup(name string)
+	LeaveGroup(name string)
+	GetGroups() []string
 	GetClientAddr() *net.TCPAddr
 	GetServerAddr() *net.TCPAddr
 	GetStartTime() time.Time
+	GetBytesRead() int64
+	GetBytesWritten() int64
+	Handshake() error
+	IsTLS() bool
+	GetPeerIdentity() (*PeerIdentity, error)
 	SetContext(ctx *context.Context)
 	GetContext() *context.Context
 
@@ -67,8 +124,25 @@ type Connection interface {
 type TCPConn struct {
 	net.Conn
 	server            *Server
+	id                uint64
+	key               string
+	groups            []string
 	ctx               *context.Context
+	cancel            context.CancelFunc
 	ts                int64
+	lastActivity      int64
+	lastRead          int64
+	heartbeatsMissed  int32
+	pins              int32
+	published         bool
+	retired           bool
+	peeked            *bufio.Reader
+	bandwidth         atomic.Pointer[bandwidthLimiter]
+	recording         atomic.Pointer[sessionRecording]
+	bytesRead         int64
+	bytesWritten      int64
+	closeReason       int32
+	readErrReason     int32
 	_cacheLinePadding [24]byte
 }
 
@@ -88,8 +162,51 @@ type ListenConfig struct {
 	SocketFastOpenQueueLen int
 	// Enable/disable TCP_DEFER_ACCEPT (requires Linux >=2.4)
 	SocketDeferAccept bool
+
+	// The following options are applied to each accepted connection.
+
+	// Idle time before the first TCP keepalive probe is sent (0 = use Go's
+	// default of 15s, <0 disables TCP keepalive)
+	SocketKeepAliveIdle time.Duration
+	// Interval between TCP keepalive probes (0 = 15s)
+	SocketKeepAliveInterval time.Duration
+	// Number of unanswered TCP keepalive probes before the connection is
+	// dropped (0 = 9)
+	SocketKeepAliveCount int
+	// Disable TCP_NODELAY, i.e. enable Nagle's algorithm (Go sets
+	// TCP_NODELAY by default)
+	SocketDisableNoDelay bool
+	// Size of the receive buffer (SO_RCVBUF; 0 = OS default)
+	SocketReadBuffer int
+	// Size of the send buffer (SO_SNDBUF; 0 = OS default)
+	SocketWriteBuffer int
+	// Maximum time transmitted data may remain unacknowledged before the
+	// connection is dropped (TCP_USER_TIMEOUT, requires Linux >=2.6.37;
+	// 0 = OS default)
+	SocketUserTimeout time.Duration
+	// SO_LINGER timeout in seconds (0 = OS default, <0 discards unsent data
+	// and resets the connection on close)
+	SocketLinger int
+}
+
+// Context key type used for values attached to connection contexts
+type contextKey struct {
+	name string
+}
+
+func (k *contextKey) String() string {
+	return "tcpserver context value " + k.name
 }
 
+var (
+	// Context key for the connection ID (uint64)
+	ConnIDContextKey = &contextKey{"conn-id"}
+	// Context key for the client address (*net.TCPAddr)
+	ClientAddrContextKey = &contextKey{"client-addr"}
+	// Context key for the server address the connection was accepted at (*net.TCPAddr)
+	ServerAddrContextKey = &contextKey{"server-addr"}
+)
+
 // Request handler function type
 type RequestHandlerFunc func(conn Connection)
 
@@ -109,8 +226,15 @@ func NewServer(listenAddr string) (*Server, error) {
 	var s *Server
 
 	s = &Server{
-		listenAddr:   la,
-		listenConfig: defaultListenConfig,
+		listenAddrs:     []net.Addr{la},
+		listenConfig:    defaultListenConfig,
+		conns:           make(map[uint64]*TCPConn),
+		connsByKey:      make(map[string]*TCPConn),
+		groups:          make(map[string]map[uint64]*TCPConn),
+		groupBandwidth:  make(map[string]*bandwidthLimiter),
+		acceptLoopsDone: make(chan struct{}),
+		shutdownDone:    make(chan struct{}),
+		metrics:         newMetrics(),
 		connStructPool: sync.Pool{
 			New: func() interface{} {
 				conn := s.connectionCreator()
@@ -149,6 +273,22 @@ func (s *Server) EnableTLS() error {
 	return nil
 }
 
+// Enable opportunistic TLS (use server.SetTLSConfig() first): TLS is only
+// used for connections starting with a TLS handshake, all others are served
+// as plaintext. Use connection.IsTLS() to check which one is active.
+func (s *Server) EnableAutoTLS() error {
+	if s.GetTLSConfig() == nil {
+		return fmt.Errorf("no TLS config set")
+	}
+	s.autoTLSEnabled = true
+	return nil
+}
+
+// Returns whether TLS is used for all connections (as opposed to auto TLS)
+func (s *Server) tlsAlways() bool {
+	return s != nil && s.tlsEnabled && !s.autoTLSEnabled
+}
+
 // Sets listen config
 func (s *Server) SetListenConfig(config *ListenConfig) {
 	s.listenConfig = config
@@ -159,27 +299,107 @@ func (s *Server) GetListenConfig() *ListenConfig {
 	return s.listenConfig
 }
 
-// Starts listening
-func (s *Server) Listen() (err error) {
-	network := "tcp4"
-	if IsIPv6Addr(s.listenAddr) {
-		network = "tcp6"
+// Adds another address to listen on; network is one of "tcp", "tcp4",
+// "tcp6" or "unix". All addresses share handler, worker pool, limits and
+// metrics. Must be called before Listen().
+func (s *Server) AddListenAddr(network string, addr string) error {
+	switch network {
+	case "tcp", "tcp4", "tcp6":
+		la, err := net.ResolveTCPAddr(network, addr)
+		if err != nil {
+			return fmt.Errorf("error resolving address '%s': %s", addr, err)
+		}
+		s.listenAddrs = append(s.listenAddrs, la)
+	case "unix":
+		ua, err := net.ResolveUnixAddr(network, addr)
+		if err != nil {
+			return fmt.Errorf("error resolving address '%s': %s", addr, err)
+		}
+		s.listenAddrs = append(s.listenAddrs, ua)
+	default:
+		return fmt.Errorf("unsupported network '%s'", network)
 	}
+	return nil
+}
 
-	s.listenConfig.lc.Control = applyListenSocketOptions(s.listenConfig)
-	l, err := s.listenConfig.lc.Listen(*s.GetContext(), network, s.listenAddr.String())
-	if err != nil {
-		return err
+// Starts listening on all addresses; listeners previously added using
+// AddListener() are used for matching addresses instead of creating new
+// ones
+func (s *Server) Listen() (err error) {
+	provided := s.providedListeners
+	listeners := make([]net.Listener, 0, len(s.listenAddrs)+len(provided))
+	created := make([]net.Listener, 0, len(s.listenAddrs))
+
+	for _, addr := range s.listenAddrs {
+		if i := indexListener(provided, addr); i >= 0 {
+			listeners = append(listeners, provided[i])
+			provided = append(provided[:i:i], provided[i+1:]...)
+			continue
+		}
+
+		l, err := s.listen(addr)
+		if err != nil {
+			for _, l := range created {
+				_ = l.Close()
+			}
+			return err
+		}
+		listeners = append(listeners, l)
+		created = append(created, l)
 	}
-	if tcpl, ok := l.(*net.TCPListener); ok {
-		s.listener = tcpl
-	} else {
-		return fmt.Errorf("listener must be of type net.TCPListener")
+	s.listeners = append(listeners, provided...)
+	s.providedListeners = nil
+	for _, l := range s.listeners {
+		listenfd.Register(l)
 	}
 
 	return nil
 }
 
+// Starts listening on a single address
+func (s *Server) listen(addr net.Addr) (net.Listener, error) {
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		network := "tcp4"
+		if IsIPv6Addr(a) {
+			network = "tcp6"
+		}
+
+		s.listenConfig.lc.Control = applyListenSocketOptions(s.listenConfig)
+		l, err := s.listenConfig.lc.Listen(*s.GetContext(), network, a.String())
+		if err != nil {
+			return nil, err
+		}
+		if _, ok := l.(*net.TCPListener); !ok {
+			l.Close()
+			return nil, fmt.Errorf("listener must be of type net.TCPListener")
+		}
+		return l, nil
+
+	case *net.UnixAddr:
+		// remove stale socket file left behind by a previous process (but
+		// never one that is still being served)
+		if fi, err := os.Stat(a.Name); err == nil && fi.Mode()&os.ModeSocket != 0 {
+			c, err := net.DialTimeout("unix", a.Name, time.Second)
+			if err == nil {
+				c.Close()
+				return nil, fmt.Errorf("unix socket '%s' is in use by another process", a.Name)
+			}
+			if errors.Is(err, syscall.ECONNREFUSED) {
+				_ = os.Remove(a.Name)
+			}
+		}
+		l, err := net.ListenUnix("unix", a)
+		if err != nil {
+			return nil, err
+		}
+		l.SetUnlinkOnClose(true)
+		return l, nil
+	}
+
+	return nil, fmt.Errorf("unsupported listen address '%s'", addr)
+}
+
 // Starts listening using TLS
 func (s *Server) ListenTLS() (err error) {
 	err = s.EnableTLS()
@@ -190,52 +410,123 @@ func (s *Server) ListenTLS() (err error) {
 }
 
 // Sets maximum number of connections that are being accepted before the
-// server automatically shutdowns
+// server automatically shutdowns (see SetLimits() for limiting concurrent
+// connections instead)
 func (s *Server) SetMaxAcceptConnections(limit int32) {
 	atomic.StoreInt32(&s.maxAcceptConnections, limit)
 }
 
 // Returns number of currently active connections
 func (s *Server) GetActiveConnections() int32 {
-	return s.activeConnections
+	return atomic.LoadInt32(&s.activeConnections)
 }
 
 // Returns number of accepted connections
 func (s *Server) GetAcceptedConnections() int32 {
-	return s.acceptedConnections
+	return atomic.LoadInt32(&s.acceptedConnections)
 }
 
-// Returns listening address
+// Returns (first TCP) listening address
 func (s *Server) GetListenAddr() *net.TCPAddr {
-	if s.listener == nil {
-		return nil
+	for _, l := range s.listeners {
+		if addr, ok := l.Addr().(*net.TCPAddr); ok {
+			return addr
+		}
+	}
+	return nil
+}
+
+// Returns all listening addresses (*net.TCPAddr or *net.UnixAddr)
+func (s *Server) GetListenAddrs() []net.Addr {
+	addrs := make([]net.Addr, len(s.listeners))
+	for i, l := range s.listeners {
+		addrs[i] = l.Addr()
 	}
-	return s.listener.Addr().(*net.TCPAddr)
+	return addrs
+}
+
+// Gracefully shutdown server: stops accepting new connections and waits for
+// all active connections to be finished by their handlers. If ctx expires
+// before that, all remaining connections are forcibly closed.
+// Returns the number of connections that had to be killed and ctx.Err() in
+// that case.
+func (s *Server) Shutdown(ctx context.Context) (killed int, err error) {
+	s.stopAccepting()
+
+	if atomic.LoadInt32(&s.serving) == 1 {
+		select {
+		case <-s.acceptLoopsDone:
+		case <-ctx.Done():
+		}
+	}
+
+	defer s.shutdownOnce.Do(func() {
+		close(s.shutdownDone)
+	})
+
+	done := make(chan struct{})
+	go func() {
+		s.connWaitGroup.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return 0, nil
+	case <-ctx.Done():
+	}
+
+	killed = s.closeConnections()
+	atomic.AddInt32(&s.killedConnections, int32(killed))
+	return killed, ctx.Err()
 }
 
 // Gracefully shutdown server but wait no longer than d for active connections.
 // Use d = 0 to wait indefinitely for active connections.
-func (s *Server) Shutdown(d time.Duration) (err error) {
-	s.shutdownDeadline = time.Time{}
-	if d > 0 {
-		s.shutdownDeadline = time.Now().Add(d)
+func (s *Server) ShutdownTimeout(d time.Duration) (killed int, err error) {
+	ctx := context.Background()
+	if d != 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, d)
+		defer cancel()
 	}
-	s.shutdown = true
-	err = s.listener.Close()
-	if err != nil {
-		return err
-	}
-	return nil
+	return s.Shutdown(ctx)
 }
 
 // Shutdown server immediately, do not wait for any connections
 func (s *Server) Halt() (err error) {
-	return s.Shutdown(-1 * time.Second)
+	_, err = s.ShutdownTimeout(-1 * time.Second)
+	if err == context.DeadlineExceeded {
+		err = nil
+	}
+	return err
+}
+
+// Returns whether the server is shutting down
+func (s *Server) IsShutdown() bool {
+	return atomic.LoadInt32(&s.shutdown) == 1
+}
+
+// Returns number of connections that have been forcibly closed on shutdown
+func (s *Server) GetKilledConnections() int32 {
+	return atomic.LoadInt32(&s.killedConnections)
+}
+
+// Marks the server as shutting down, cancels all connection contexts and
+// closes the listeners
+func (s *Server) stopAccepting() {
+	atomic.StoreInt32(&s.shutdown, 1)
+	s.connBaseContext()
+	s.baseCancel()
+	for _, l := range s.listeners {
+		listenfd.Unregister(l)
+		_ = l.Close()
+	}
 }
 
 // Serves requests (accept / handle loop)
 func (s *Server) Serve() error {
-	if s.listener == nil {
+	if len(s.listeners) == 0 {
 		return fmt.Errorf("no valid listener found; call Listen() or ListenTLS() first")
 	}
 
@@ -248,40 +539,51 @@ func (s *Server) Serve() error {
 	s.wp.Start()
 	defer s.wp.Stop()
 
-	errChan := make(chan error, loops)
+	atomic.StoreInt32(&s.serving, 1)
+	if s.heartbeat != nil {
+		go s.heartbeatLoop()
+	}
 
-	for i := 0; i < loops; i++ {
-		go func(id int) {
-			if s.allowThreadLocking && maxProcs >= 2 && id < loops/2 {
-				runtime.LockOSThread()
-				defer runtime.UnlockOSThread()
-			}
+	numLoops := loops * len(s.listeners)
+	errChan := make(chan error, numLoops)
+
+	for _, l := range s.listeners {
+		for i := 0; i < loops; i++ {
+			go func(l net.Listener, id int) {
+				if s.allowThreadLocking && maxProcs >= 2 && id < loops/2 {
+					runtime.LockOSThread()
+					defer runtime.UnlockOSThread()
+				}
 
-			errChan <- s.acceptLoop(id)
-		}(i)
+				errChan <- s.acceptLoop(l, id)
+			}(l, i)
+		}
 	}
 
-	for i := 0; i < loops; i++ {
-		err := <-errChan
-		if err != nil {
-			return err
+	var err error
+	for i := 0; i < numLoops; i++ {
+		if loopErr := <-errChan; loopErr != nil && err == nil {
+			err = loopErr
 		}
 	}
+	close(s.acceptLoopsDone)
 
-	if s.activeConnections == 0 {
-		return nil
+	if err != nil {
+		return err
 	}
 
-	if s.shutdownDeadline.IsZero() {
-		// just wait for all connections to be closed
+	// wait for either all connections to be closed (i.e. the server shut
+	// itself down after reaching max accept connections) or Shutdown() to
+	// return
+	done := make(chan struct{})
+	go func() {
 		s.connWaitGroup.Wait()
+		close(done)
+	}()
 
-	} else {
-		diff := s.shutdownDeadline.Sub(time.Now())
-		if diff > 0 {
-			// wait specified time for still active connections to be closed
-			time.Sleep(diff)
-		}
+	select {
+	case <-done:
+	case <-s.shutdownDone:
 	}
 
 	return nil
@@ -312,6 +614,17 @@ func (s *Server) GetContext() *context.Context {
 	return s.ctx
 }
 
+// Returns the parent context of all connection contexts which is derived
+// from the server's context and cancelled on shutdown
+func (s *Server) connBaseContext() context.Context {
+	s.ctxMu.Lock()
+	defer s.ctxMu.Unlock()
+	if s.baseCtx == nil {
+		s.baseCtx, s.baseCancel = context.WithCancel(*s.GetContext())
+	}
+	return s.baseCtx
+}
+
 // Sets number of accept loops
 func (s *Server) SetLoops(loops int) {
 	s.loops = loops
@@ -340,7 +653,7 @@ func (s *Server) SetBallast(sizeInMiB int) {
 }
 
 // Main accept loop
-func (s *Server) acceptLoop(id int) error {
+func (s *Server) acceptLoop(listener net.Listener, id int) error {
 	var (
 		tempDelay time.Duration
 		tcpConn   net.Conn
@@ -348,16 +661,15 @@ func (s *Server) acceptLoop(id int) error {
 	)
 
 	for {
-		if s.maxAcceptConnections > 0 && s.acceptedConnections >= s.maxAcceptConnections {
-			s.Shutdown(0)
+		if s.maxAcceptConnections > 0 && atomic.LoadInt32(&s.acceptedConnections) >= s.maxAcceptConnections {
+			s.stopAccepting()
 		}
 
-		if s.shutdown {
-			_ = s.listener.Close()
+		if s.IsShutdown() {
 			break
 		}
 
-		tcpConn, err = s.listener.AcceptTCP()
+		tcpConn, err = listener.Accept()
 		if err != nil {
 			if opErr, ok := err.(*net.OpError); ok {
 
@@ -366,11 +678,12 @@ func (s *Server) acceptLoop(id int) error {
 					continue
 				}
 
-				if !(opErr.Temporary() && opErr.Timeout()) && s.shutdown {
+				if !(opErr.Temporary() && opErr.Timeout()) && s.IsShutdown() {
 					break
 				}
 
 				if opErr.Temporary() {
+					atomic.AddInt64(&s.metrics.acceptErrors, 1)
 					if tempDelay == 0 {
 						tempDelay = 10 * time.Millisecond
 					} else {
@@ -387,7 +700,8 @@ func (s *Server) acceptLoop(id int) error {
 
 			}
 
-			s.listener.Close()
+			atomic.AddInt64(&s.metrics.acceptErrors, 1)
+			s.stopAccepting()
 			return err
 		}
 
@@ -403,6 +717,16 @@ func (s *Server) acceptLoop(id int) error {
 			continue
 		}
 
+		if !s.deferAdmission(tcpConn) && (!s.filterConn(tcpConn) || !s.admitConn(tcpConn)) {
+			tcpConn.Close()
+			continue
+		}
+
+		if err := applyConnSocketOptions(tcpConn, s.listenConfig); err != nil {
+			s.logf("tcpserver: error applying socket options to connection from %s: %s", tcpConn.RemoteAddr(), err)
+		}
+
+		s.connWaitGroup.Add(1)
 		s.wp.AddTask(tcpConn)
 		//go s.serveConn(tcpConn)
 		tcpConn = nil
@@ -412,32 +736,79 @@ func (s *Server) acceptLoop(id int) error {
 
 // Serve a single connection (called from ultrapool)
 func (s *Server) serveConn(task ultrapool.Task) {
-	conn := s.connStructPool.Get().(*TCPConn)
-	netConn := task.(net.Conn)
+	rawConn := task.(net.Conn)
+	netConn := rawConn
+	// connection whose remote address has been admitted by the limits
+	admitted := rawConn
 
 	atomic.AddInt32(&s.activeConnections, 1)
 
-	if s.tlsEnabled {
+	if s.deferAdmission(rawConn) {
+		var err error
+		netConn, err = s.proxyProtocol.wrapConn(rawConn)
+		if err == nil && !s.filterConn(netConn) {
+			err = ErrConnectionDenied
+		}
+		if err != nil || !s.admitConn(netConn) {
+			_ = rawConn.Close()
+			s.finishConn(nil)
+			return
+		}
+		admitted = netConn
+	}
+
+	if !s.acceptHook(netConn) {
+		_ = rawConn.Close()
+		s.finishConn(admitted)
+		return
+	}
+
+	if s.tlsEnabled && !s.autoTLSEnabled {
 		netConn = tls.Server(netConn, s.GetTLSConfig())
 	}
 
+	conn := s.connStructPool.Get().(*TCPConn)
 	conn.Reset(netConn)
 	conn.Start()
-	s.requestHandler(conn)
+	conn.id = atomic.AddUint64(&s.lastConnID, 1)
+	conn.initContext(s.connBaseContext())
+	conn.initBandwidthLimit()
+	conn.startRecording("")
+	s.trackConn(conn, true)
+	s.runHandler(conn)
 	conn.Close()
-	atomic.AddInt32(&s.activeConnections, -1)
+	conn.cancel()
+	s.metrics.observeDuration(time.Since(conn.GetStartTime()))
+	s.closeHook(conn)
+	conn.stopRecording()
+	if s.trackConn(conn, false) {
+		s.connStructPool.Put(conn)
+	}
 
-	s.connStructPool.Put(conn)
+	s.finishConn(admitted)
 }
 
-// Returns client IP and port
+// Releases all resources held by an accepted connection; admitted is the
+// connection passed to admitConn() (nil if not admitted)
+func (s *Server) finishConn(admitted net.Conn) {
+	if admitted != nil {
+		s.releaseConn(admitted)
+	}
+	atomic.AddInt32(&s.activeConnections, -1)
+	s.connWaitGroup.Done()
+}
+
+// Returns client IP and port (nil for Unix domain socket connections)
 func (conn *TCPConn) GetClientAddr() *net.TCPAddr {
-	return conn.RemoteAddr().(*net.TCPAddr)
+	addr, _ := conn.RemoteAddr().(*net.TCPAddr)
+	return addr
 }
 
-// Returns server IP and port (the addr the connection was accepted at)
+// Returns server IP and port (the addr the connection was accepted at; nil
+// for Unix domain socket connections)
 func (conn *TCPConn) GetServerAddr() *net.TCPAddr {
-	return conn.LocalAddr().(*net.TCPAddr)
+	addr, _ := conn.LocalAddr().(*net.TCPAddr)
+	return addr
 }
 
 // Returns start timestamp
@@ -450,7 +821,12 @@ func (conn *TCPConn) SetContext(ctx *context.Context) {
 	conn.ctx = ctx
 }
 
-// Returns connection's context or creates a new one if none is present
+// Returns connection's context or creates a new one if none is present.
+// For connections served by a Server the context is derived from the server's
+// context, carries the connection ID as well as client and server address
+// and is cancelled on server shutdown or as soon as the peer disconnects.
+// Cancellation also interrupts pending and subsequent reads (returning the
+// context's error) but not writes.
 func (conn *TCPConn) GetContext() *context.Context {
 	if conn.ctx == nil {
 		ctx := context.Background()
@@ -459,7 +835,150 @@ func (conn *TCPConn) GetContext() *context.Context {
 	return conn.ctx
 }
 
-// Returns underlying net.Conn connection (most likely either *net.TCPConn or *tls.Conn)
+// Creates the connection's context as a child of parent
+func (conn *TCPConn) initContext(parent context.Context) {
+	ctx, cancel := context.WithCancel(parent)
+	ctx = context.WithValue(ctx, ConnIDContextKey, conn.id)
+	if addr, ok := conn.RemoteAddr().(*net.TCPAddr); ok {
+		ctx = context.WithValue(ctx, ClientAddrContextKey, addr)
+	}
+	if addr, ok := conn.LocalAddr().(*net.TCPAddr); ok {
+		ctx = context.WithValue(ctx, ServerAddrContextKey, addr)
+	}
+	conn.ctx = &ctx
+
+	// unblock reads once cancelled; the net.Conn is captured as the
+	// connection struct may be reused when this runs late
+	netConn := conn.Conn
+	stop := context.AfterFunc(ctx, func() {
+		_ = netConn.SetReadDeadline(time.Now())
+	})
+	conn.cancel = func() {
+		stop()
+		cancel()
+	}
+}
+
+// Returns the error of the context of a connection served by a Server
+// (nil if it has not been cancelled)
+func (conn *TCPConn) contextErr() error {
+	if conn.cancel == nil || conn.ctx == nil {
+		return nil
+	}
+	return (*conn.ctx).Err()
+}
+
+// Returns the server-wide unique connection ID (0 if not served by a Server)
+func (conn *TCPConn) GetID() uint64 {
+	return conn.id
+}
+
+// Reads data from the connection enforcing the server's read and idle
+// timeouts as well as bandwidth limits; cancels the connection's context
+// once the peer has disconnected
+func (conn *TCPConn) Read(b []byte) (n int, err error) {
+	if len(b) == 0 {
+		return conn.reader().Read(b)
+	}
+	limiters := conn.rateLimiters(false)
+	if len(limiters) > 0 {
+		b = b[:minBurst(limiters, len(b))]
+	}
+
+	op := conn.applyReadDeadline()
+	n, err = conn.reader().Read(b)
+	if n > 0 && len(limiters) > 0 {
+		_ = waitRateLimiters(*conn.GetContext(), limiters, n)
+	}
+	if n > 0 {
+		conn.record(DirectionRead, b[:n])
+		atomic.AddInt64(&conn.bytesRead, int64(n))
+		atomic.StoreInt64(&conn.lastRead, time.Now().UnixNano())
+		if conn.server != nil {
+			atomic.AddInt64(&conn.server.metrics.bytesRead, int64(n))
+		}
+		conn.touch()
+	}
+	if ctxErr := conn.contextErr(); ctxErr != nil && errors.Is(err, os.ErrDeadlineExceeded) {
+		// interrupted by the context (see initContext())
+		return n, ctxErr
+	}
+	conn.trackReadError(err)
+	if err != nil {
+		if conn.cancel != nil && isDisconnectError(err) {
+			conn.cancel()
+		}
+		err = wrapTimeoutError(op, err)
+	}
+	return
+}
+
+// Writes data to the connection enforcing the server's write timeout and
+// bandwidth limits
+func (conn *TCPConn) Write(b []byte) (n int, err error) {
+	var timeout time.Duration
+	if conn.server != nil {
+		timeout = conn.server.writeTimeout
+	}
+	return conn.write(b, timeout)
+}
+
+// Writes data applying write timeout d (if positive)
+func (conn *TCPConn) write(b []byte, d time.Duration) (n int, err error) {
+	if limiters := conn.rateLimiters(true); len(limiters) > 0 {
+		return conn.writeThrottled(b, d, limiters)
+	}
+
+	op := conn.applyWriteDeadline(d)
+	n, err = conn.Conn.Write(b)
+	if n > 0 {
+		conn.record(DirectionWrite, b[:n])
+		atomic.AddInt64(&conn.bytesWritten, int64(n))
+		if conn.server != nil {
+			atomic.AddInt64(&conn.server.metrics.bytesWritten, int64(n))
+		}
+		conn.touch()
+	}
+	if err != nil {
+		err = wrapTimeoutError(op, err)
+	}
+	return
+}
+
+// Writes data in chunks not exceeding the limiters' burst sizes; the write
+// timeout applies to each chunk without the time spent waiting for tokens
+func (conn *TCPConn) writeThrottled(b []byte, d time.Duration, limiters []*rateLimiter) (n int, err error) {
+	chunkSize := minBurst(limiters, len(b))
+	ctx := *conn.GetContext()
+	for len(b) > 0 {
+		chunk := b
+		if len(chunk) > chunkSize {
+			chunk = chunk[:chunkSize]
+		}
+		if err = waitRateLimiters(ctx, limiters, len(chunk)); err != nil {
+			return
+		}
+
+		op := conn.applyWriteDeadline(d)
+		var written int
+		written, err = conn.Conn.Write(chunk)
+		if written > 0 {
+			conn.record(DirectionWrite, chunk[:written])
+			n += written
+			atomic.AddInt64(&conn.bytesWritten, int64(written))
+			atomic.AddInt64(&conn.server.metrics.bytesWritten, int64(written))
+			conn.touch()
+		}
+		if err != nil {
+			return n, wrapTimeoutError(op, err)
+		}
+		b = b[written:]
+	}
+	return
+}
+
+// Returns underlying net.Conn connection (most likely either *net.TCPConn or *tls.Conn).
+// Data buffered by connection.Peek() is only returned by connection.Read().
 func (conn *TCPConn) GetNetConn() net.Conn {
 	return conn.Conn
 }
@@ -483,12 +1002,28 @@ func (conn *TCPConn) GetServer() *Server {
 // Resets the TCPConn for re-use
 func (conn *TCPConn) Reset(netConn net.Conn) {
 	conn.Conn = netConn
+	conn.peeked = nil
+	conn.recording.Store(nil)
+	conn.id = 0
+	conn.key = ""
+	conn.groups = nil
+	conn.pins = 0
+	conn.published = false
+	conn.retired = false
 	conn.ctx = nil
+	conn.cancel = nil
+	atomic.StoreInt64(&conn.bytesRead, 0)
+	atomic.StoreInt64(&conn.bytesWritten, 0)
+	atomic.StoreInt32(&conn.closeReason, 0)
+	atomic.StoreInt32(&conn.readErrReason, 0)
+	atomic.StoreInt32(&conn.heartbeatsMissed, 0)
 }
 
 // Sets start timer to "now"
 func (conn *TCPConn) Start() {
 	conn.ts = time.Now().UnixNano()
+	atomic.StoreInt64(&conn.lastActivity, conn.ts)
+	atomic.StoreInt64(&conn.lastRead, conn.ts)
 }
 
 // Starts TLS inline
@@ -499,7 +1034,25 @@ func (conn *TCPConn) StartTLS(config *tls.Config) error {
 	if config == nil {
 		return fmt.Errorf("no valid TLS config given")
 	}
-	conn.Conn = tls.Server(conn.Conn, config)
+	conn.Conn = tls.Server(conn.unpeek(), config)
+	return nil
+}
+
+// Returns whether the connection uses TLS
+func (conn *TCPConn) IsTLS() bool {
+	_, ok := conn.Conn.(*tls.Conn)
+	return ok
+}
+
+// Starts TLS if the client begins with a TLS handshake record
+func (conn *TCPConn) detectTLS(config *tls.Config) error {
+	peek, err := conn.Peek(1)
+	if err != nil {
+		return err
+	}
+	if peek[0] == 0x16 {
+		return conn.StartTLS(config)
+	}
 	return nil
 }
 
@@ -507,3 +1060,16 @@ func (conn *TCPConn) StartTLS(config *tls.Config) error {
 func IsIPv6Addr(addr *net.TCPAddr) bool {
 	return addr.IP.To4() == nil && len(addr.IP) == net.IPv6len
 }
+
+// Checks whether err denotes a connection closed by the peer (or locally)
+// rather than e.g. a read timeout
+func isDisconnectError(err error) bool {
+	if err == io.EOF || errors.Is(err, net.ErrClosed) {
+		return true
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return false
+	}
+	return true
+}
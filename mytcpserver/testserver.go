@@ -0,0 +1,131 @@
+package tcpserver
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/maurice2k/ultrapool"
+)
+
+// In-memory server for testing request handlers without binding ports.
+// Connections created using Dial() run through the same code path as
+// accepted connections (filters, limits, hooks, TLS, pooling, context)
+// but use in-memory pipes instead of sockets.
+// Configure it like any other server (the embedded *Server) before dialing.
+type TestServer struct {
+	*Server
+	mu       sync.Mutex
+	lastPort uint32
+	started  bool
+}
+
+// Creates a new in-memory test server serving connections using handler
+func NewTestServer(handler RequestHandlerFunc) *TestServer {
+	s, _ := NewServer("127.0.0.1:0")
+	s.SetBallast(0)
+	s.SetRequestHandler(handler)
+	return &TestServer{Server: s}
+}
+
+// Opens a new connection to the server and returns its client side. If the
+// connection is rejected (IP filter, limits, accept hook) the returned
+// connection is closed by the server.
+func (ts *TestServer) Dial() (net.Conn, error) {
+	client, server := net.Pipe()
+	port := int(1024 + atomic.AddUint32(&ts.lastPort, 1)%64000)
+	netConn := &pipeConn{
+		Conn:       server,
+		localAddr:  ts.listenAddrs[0],
+		remoteAddr: &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: port},
+	}
+
+	if ts.IsShutdown() {
+		client.Close()
+		server.Close()
+		return nil, net.ErrClosed
+	}
+	deferred := ts.deferAdmission(netConn)
+	if !deferred && (!ts.filterConn(netConn) || !ts.admitConn(netConn)) {
+		netConn.Close()
+		return client, nil
+	}
+
+	ts.mu.Lock()
+	if ts.IsShutdown() {
+		ts.mu.Unlock()
+		if !deferred {
+			ts.releaseConn(netConn)
+		}
+		client.Close()
+		netConn.Close()
+		return nil, net.ErrClosed
+	}
+	ts.connWaitGroup.Add(1)
+	if !ts.started {
+		ts.start()
+	}
+	ts.mu.Unlock()
+
+	atomic.AddInt32(&ts.acceptedConnections, 1)
+	ts.wp.AddTask(netConn)
+	return client, nil
+}
+
+// Starts the worker pool (and the heartbeat loop) on first use like
+// Serve(); mu must be held
+func (ts *TestServer) start() {
+	ts.started = true
+	ts.wp = ultrapool.NewWorkerPool(ts.serveConn)
+	ts.wp.SetNumShards(runtime.GOMAXPROCS(0))
+	ts.wp.SetIdleWorkerLifetime(5 * time.Second)
+	ts.wp.Start()
+	if ts.heartbeat != nil {
+		go ts.heartbeatLoop()
+	}
+}
+
+// Opens a new TLS connection to the server (use server.EnableTLS() or
+// server.EnableAutoTLS() first)
+func (ts *TestServer) DialTLS(config *tls.Config) (net.Conn, error) {
+	conn, err := ts.Dial()
+	if err != nil {
+		return nil, err
+	}
+	return tls.Client(conn, config), nil
+}
+
+// Forcibly closes all connections and waits for their handlers to return
+func (ts *TestServer) Close() {
+	ts.mu.Lock()
+	ts.stopAccepting()
+	started := ts.started
+	ts.mu.Unlock()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	ts.Shutdown(ctx)
+	ts.connWaitGroup.Wait()
+	if started {
+		ts.wp.Stop()
+	}
+}
+
+// Server side of an in-memory connection with TCP addresses
+type pipeConn struct {
+	net.Conn
+	localAddr  net.Addr
+	remoteAddr net.Addr
+}
+
+func (c *pipeConn) LocalAddr() net.Addr {
+	return c.localAddr
+}
+
+func (c *pipeConn) RemoteAddr() net.Addr {
+	return c.remoteAddr
+}
@@ -0,0 +1,313 @@
+package tcpserver
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"sync"
+	"testing"
+	"time"
+)
+
+func echoHandler(conn Connection) {
+	_, _ = io.Copy(conn, conn)
+}
+
+func TestTestServerEcho(t *testing.T) {
+	t.Parallel()
+
+	ts := NewTestServer(echoHandler)
+	defer ts.Close()
+
+	conn, err := ts.Dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	if _, err := conn.Write([]byte("ping")); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 4)
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		t.Fatal(err)
+	}
+	if string(buf) != "ping" {
+		t.Fatalf("got %q, want %q", buf, "ping")
+	}
+}
+
+func TestTestServerParallelConnections(t *testing.T) {
+	t.Parallel()
+
+	ts := NewTestServer(echoHandler)
+	defer ts.Close()
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 50)
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			conn, err := ts.Dial()
+			if err != nil {
+				errs <- err
+				return
+			}
+			defer conn.Close()
+
+			msg := []byte(fmt.Sprintf("message %02d", i))
+			if _, err := conn.Write(msg); err != nil {
+				errs <- err
+				return
+			}
+			buf := make([]byte, len(msg))
+			if _, err := io.ReadFull(conn, buf); err != nil {
+				errs <- err
+				return
+			}
+			if !bytes.Equal(buf, msg) {
+				errs <- fmt.Errorf("got %q, want %q", buf, msg)
+			}
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+}
+
+func TestTestServerContextAndHooks(t *testing.T) {
+	t.Parallel()
+
+	closed := make(chan *CloseInfo, 1)
+	ts := NewTestServer(func(conn Connection) {
+		ctx := *conn.GetContext()
+		if ctx.Value(ConnIDContextKey) != conn.GetID() || conn.GetClientAddr() == nil {
+			_, _ = conn.Write([]byte("bad"))
+			return
+		}
+		_, _ = conn.Write([]byte("ok"))
+	})
+	ts.SetOnClose(func(conn Connection, info *CloseInfo) {
+		closed <- info
+	})
+	defer ts.Close()
+
+	conn, err := ts.Dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	resp, err := io.ReadAll(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(resp) != "ok" {
+		t.Fatalf("got %q, want %q", resp, "ok")
+	}
+
+	select {
+	case info := <-closed:
+		if info.Reason != CloseReasonHandlerDone || info.BytesWritten != 2 {
+			t.Fatalf("unexpected close info %+v", info)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("close hook not called")
+	}
+}
+
+func TestTestServerRouter(t *testing.T) {
+	t.Parallel()
+
+	codec := NewLengthPrefixCodec(2)
+	router := NewRouter(codec, ByteCommand(0))
+	router.Handle(1, func(req *Request) error {
+		return req.Reply(append([]byte{2}, bytes.ToUpper(req.Frame[1:])...))
+	})
+
+	ts := NewTestServer(router.ServeConn)
+	defer ts.Close()
+
+	conn, err := ts.Dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	framer := NewFramer(conn, codec)
+	if err := framer.WriteFrame([]byte("\x01hello")); err != nil {
+		t.Fatal(err)
+	}
+	frame, err := framer.ReadFrame()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(frame) != "\x02HELLO" {
+		t.Fatalf("got %q", frame)
+	}
+
+	// unknown commands close the connection
+	if err := framer.WriteFrame([]byte("\x09")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := framer.ReadFrame(); !errors.Is(err, io.EOF) {
+		t.Fatalf("got %v, want EOF", err)
+	}
+}
+
+func TestTestServerTLS(t *testing.T) {
+	t.Parallel()
+
+	ts := NewTestServer(echoHandler)
+	ts.SetTLSConfig(&tls.Config{Certificates: []tls.Certificate{testCertificate(t)}})
+	if err := ts.EnableTLS(); err != nil {
+		t.Fatal(err)
+	}
+	defer ts.Close()
+
+	conn, err := ts.DialTLS(&tls.Config{InsecureSkipVerify: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	if _, err := conn.Write([]byte("secret")); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 6)
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		t.Fatal(err)
+	}
+	if string(buf) != "secret" {
+		t.Fatalf("got %q, want %q", buf, "secret")
+	}
+}
+
+func TestTestServerClose(t *testing.T) {
+	t.Parallel()
+
+	ts := NewTestServer(echoHandler)
+	conn, err := ts.Dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ts.Close()
+	if _, err := conn.Read(make([]byte, 1)); err == nil {
+		t.Fatal("connection still open after Close()")
+	}
+	if _, err := ts.Dial(); err == nil {
+		t.Fatal("Dial() succeeded after Close()")
+	}
+}
+
+func TestTestServerShutdownInterruptsRead(t *testing.T) {
+	t.Parallel()
+
+	reading := make(chan struct{})
+	result := make(chan error, 1)
+	ts := NewTestServer(func(conn Connection) {
+		close(reading)
+		_, err := conn.Read(make([]byte, 1))
+		result <- err
+		// writes still work so that handlers can say goodbye
+		_, _ = conn.Write([]byte("bye"))
+	})
+	conn, err := ts.Dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	<-reading
+	shutdown := make(chan int, 1)
+	go func() {
+		killed, _ := ts.ShutdownTimeout(5 * time.Second)
+		shutdown <- killed
+	}()
+
+	buf := make([]byte, 3)
+	if _, err := io.ReadFull(conn, buf); err != nil || string(buf) != "bye" {
+		t.Fatalf("got %q (%v), want %q", buf, err, "bye")
+	}
+	if err := <-result; !errors.Is(err, context.Canceled) {
+		t.Fatalf("got %v, want context.Canceled", err)
+	}
+	if killed := <-shutdown; killed != 0 {
+		t.Fatalf("%d connections killed, want 0", killed)
+	}
+	ts.Close()
+}
+
+// Returns a self-signed certificate for localhost
+func testCertificate(t *testing.T) tls.Certificate {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "localhost"},
+		DNSNames:     []string{"localhost"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+func TestTestServerThrottledWrite(t *testing.T) {
+	t.Parallel()
+
+	// waiting for the bandwidth limit must not count against the write timeout
+	result := make(chan error, 1)
+	ts := NewTestServer(func(conn Connection) {
+		if _, err := conn.Read(nil); err != nil {
+			result <- fmt.Errorf("zero-length read: %w", err)
+			return
+		}
+		if _, err := io.ReadFull(conn, make([]byte, 1)); err != nil {
+			result <- err
+			return
+		}
+		_, err := conn.Write(make([]byte, 3000))
+		result <- err
+	})
+	ts.SetWriteTimeout(100 * time.Millisecond)
+	ts.SetBandwidthLimit(&RateLimit{BytesPerSecond: 4000, Burst: 1000}, &RateLimit{BytesPerSecond: 4000, Burst: 1000})
+	defer ts.Close()
+
+	conn, err := ts.Dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	if _, err := conn.Write([]byte("x")); err != nil {
+		t.Fatal(err)
+	}
+	n, err := io.ReadFull(conn, make([]byte, 3000))
+	if err != nil {
+		t.Fatalf("read %d bytes: %s", n, err)
+	}
+	if err := <-result; err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,178 @@
+package tcpserver
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Bandwidth limit
+type RateLimit struct {
+	// Bytes per second
+	BytesPerSecond float64
+	// Maximum number of bytes that may be transferred at once (defaults to
+	// BytesPerSecond, i.e. one second worth of data)
+	Burst int
+}
+
+// Token bucket based bandwidth limiter; safe for concurrent use
+type rateLimiter struct {
+	mu     sync.Mutex
+	bucket *tokenBucket
+}
+
+// Creates a new limiter (nil if limit is nil or unlimited)
+func newRateLimiter(limit *RateLimit) *rateLimiter {
+	if limit == nil || limit.BytesPerSecond <= 0 {
+		return nil
+	}
+	burst := limit.Burst
+	if burst <= 0 {
+		burst = int(limit.BytesPerSecond)
+	}
+	return &rateLimiter{bucket: newTokenBucket(limit.BytesPerSecond, burst)}
+}
+
+// Returns maximum chunk size
+func (r *rateLimiter) burst() int {
+	return int(r.bucket.burst)
+}
+
+// Takes n tokens and waits until the bucket has recovered from the debt
+func (r *rateLimiter) wait(ctx context.Context, n int) error {
+	r.mu.Lock()
+	r.bucket.refill(time.Now())
+	r.bucket.tokens -= float64(n)
+	deficit := -r.bucket.tokens
+	r.mu.Unlock()
+
+	if deficit <= 0 {
+		return nil
+	}
+
+	timer := time.NewTimer(time.Duration(deficit / r.bucket.rate * float64(time.Second)))
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Read and write limiter pair
+type bandwidthLimiter struct {
+	read  *rateLimiter
+	write *rateLimiter
+}
+
+func newBandwidthLimiter(read *RateLimit, write *RateLimit) *bandwidthLimiter {
+	bl := &bandwidthLimiter{read: newRateLimiter(read), write: newRateLimiter(write)}
+	if bl.read == nil && bl.write == nil {
+		return nil
+	}
+	return bl
+}
+
+// Sets global bandwidth limits shared by all connections (nil = unlimited);
+// safe to call while the server is running
+func (s *Server) SetBandwidthLimit(read *RateLimit, write *RateLimit) {
+	s.globalBandwidth.Store(newBandwidthLimiter(read, write))
+	s.updateThrottling()
+}
+
+// Sets default per-connection bandwidth limits (nil = unlimited) applied to
+// connections accepted afterwards; see connection.SetBandwidthLimit() for
+// changing the limits of a single connection
+func (s *Server) SetConnBandwidthLimit(read *RateLimit, write *RateLimit) {
+	s.connBandwidth.Store(&[2]*RateLimit{read, write})
+	s.updateThrottling()
+}
+
+// Sets bandwidth limits shared by all members of the named group (nil =
+// unlimited); safe to call while the server is running
+func (s *Server) SetGroupBandwidthLimit(name string, read *RateLimit, write *RateLimit) {
+	s.groupsMu.Lock()
+	if bl := newBandwidthLimiter(read, write); bl != nil {
+		s.groupBandwidth[name] = bl
+	} else {
+		delete(s.groupBandwidth, name)
+	}
+	s.groupsMu.Unlock()
+	s.updateThrottling()
+}
+
+// Overrides the bandwidth limits of the connection (nil = unlimited)
+func (conn *TCPConn) SetBandwidthLimit(read *RateLimit, write *RateLimit) {
+	conn.bandwidth.Store(newBandwidthLimiter(read, write))
+	if s := conn.server; s != nil {
+		atomic.StoreInt32(&s.throttling, 1)
+	}
+}
+
+// Enables the throttling code path once any limit has been set
+func (s *Server) updateThrottling() {
+	atomic.StoreInt32(&s.throttling, 1)
+}
+
+// Creates the connection's limiter from the server's default limits
+func (conn *TCPConn) initBandwidthLimit() {
+	conn.bandwidth.Store(nil)
+	if limits := conn.server.connBandwidth.Load(); limits != nil {
+		conn.bandwidth.Store(newBandwidthLimiter(limits[0], limits[1]))
+	}
+}
+
+// Returns all limiters applying to the connection for given direction
+func (conn *TCPConn) rateLimiters(write bool) []*rateLimiter {
+	s := conn.server
+	if s == nil || atomic.LoadInt32(&s.throttling) == 0 {
+		return nil
+	}
+
+	var limiters []*rateLimiter
+	add := func(bl *bandwidthLimiter) {
+		if bl == nil {
+			return
+		}
+		if write && bl.write != nil {
+			limiters = append(limiters, bl.write)
+		} else if !write && bl.read != nil {
+			limiters = append(limiters, bl.read)
+		}
+	}
+
+	add(conn.bandwidth.Load())
+	s.groupsMu.RLock()
+	for _, name := range conn.groups {
+		add(s.groupBandwidth[name])
+	}
+	s.groupsMu.RUnlock()
+	add(s.globalBandwidth.Load())
+
+	return limiters
+}
+
+// Returns the smallest burst of given limiters, limited to max
+func minBurst(limiters []*rateLimiter, max int) int {
+	for _, l := range limiters {
+		if burst := l.burst(); burst < max {
+			max = burst
+		}
+	}
+	if max < 1 {
+		max = 1
+	}
+	return max
+}
+
+// Waits until all limiters allow n more bytes
+func waitRateLimiters(ctx context.Context, limiters []*rateLimiter, n int) error {
+	for _, l := range limiters {
+		if err := l.wait(ctx, n); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,150 @@
+package tcpserver
+
+import (
+	"errors"
+	"net"
+	"os"
+	"sync/atomic"
+	"time"
+)
+
+// Returned (wrapped in a *TimeoutError) whenever a read or write on a
+// connection exceeds the server's read, write or idle timeout
+var ErrTimeout = errors.New("tcpserver: i/o timeout")
+
+// Timeout error returned by TCPConn.Read() and TCPConn.Write()
+type TimeoutError struct {
+	// Either "read", "write" or "idle"
+	Op  string
+	Err error
+}
+
+func (e *TimeoutError) Error() string {
+	return "tcpserver: " + e.Op + " timeout: " + e.Err.Error()
+}
+
+func (e *TimeoutError) Unwrap() error {
+	return e.Err
+}
+
+func (e *TimeoutError) Is(target error) bool {
+	return target == ErrTimeout
+}
+
+// Implements net.Error
+func (e *TimeoutError) Timeout() bool {
+	return true
+}
+
+// Implements net.Error
+func (e *TimeoutError) Temporary() bool {
+	return true
+}
+
+// Sets maximum duration a single read may block (0 disables the timeout)
+func (s *Server) SetReadTimeout(d time.Duration) {
+	s.readTimeout = d
+}
+
+// Returns read timeout
+func (s *Server) GetReadTimeout() time.Duration {
+	return s.readTimeout
+}
+
+// Sets maximum duration a single write may block (0 disables the timeout)
+func (s *Server) SetWriteTimeout(d time.Duration) {
+	s.writeTimeout = d
+}
+
+// Returns write timeout
+func (s *Server) GetWriteTimeout() time.Duration {
+	return s.writeTimeout
+}
+
+// Sets maximum duration a connection may be idle, i.e. neither reads nor
+// writes any data (0 disables the timeout)
+func (s *Server) SetIdleTimeout(d time.Duration) {
+	s.idleTimeout = d
+}
+
+// Returns idle timeout
+func (s *Server) GetIdleTimeout() time.Duration {
+	return s.idleTimeout
+}
+
+// Returns time of last read or write activity
+func (conn *TCPConn) GetLastActivity() time.Time {
+	ts := atomic.LoadInt64(&conn.lastActivity)
+	return time.Unix(ts/1e9, ts%1e9)
+}
+
+// Writes data to the connection using write timeout d instead of the
+// server's write timeout
+func (conn *TCPConn) WriteTimeout(b []byte, d time.Duration) (n int, err error) {
+	if d <= 0 {
+		return conn.Write(b)
+	}
+	n, err = conn.write(b, d)
+	if conn.server == nil || conn.server.writeTimeout <= 0 {
+		_ = conn.Conn.SetWriteDeadline(time.Time{})
+	}
+	return
+}
+
+// Marks the connection as active "now"
+func (conn *TCPConn) touch() {
+	atomic.StoreInt64(&conn.lastActivity, time.Now().UnixNano())
+}
+
+// Sets the read deadline according to the server's read and idle timeouts;
+// returns which of both is going to hit first ("" if none is set)
+func (conn *TCPConn) applyReadDeadline() string {
+	if conn.server == nil {
+		return ""
+	}
+	if conn.contextErr() != nil {
+		// keep reads interrupted once the context has been cancelled
+		_ = conn.Conn.SetReadDeadline(time.Now())
+		return ""
+	}
+	rt, it := conn.server.readTimeout, conn.server.idleTimeout
+	if rt <= 0 && it <= 0 {
+		return ""
+	}
+
+	op := "read"
+	var deadline time.Time
+	if rt > 0 {
+		deadline = time.Now().Add(rt)
+	}
+	if it > 0 {
+		idleDeadline := conn.GetLastActivity().Add(it)
+		if deadline.IsZero() || idleDeadline.Before(deadline) {
+			deadline = idleDeadline
+			op = "idle"
+		}
+	}
+	_ = conn.Conn.SetReadDeadline(deadline)
+	return op
+}
+
+// Sets the write deadline to d from now; returns "" if d is not positive
+func (conn *TCPConn) applyWriteDeadline(d time.Duration) string {
+	if d <= 0 {
+		return ""
+	}
+	_ = conn.Conn.SetWriteDeadline(time.Now().Add(d))
+	return "write"
+}
+
+// Wraps deadline errors caused by one of the server's timeouts into a *TimeoutError
+func wrapTimeoutError(op string, err error) error {
+	if op == "" || err == nil {
+		return err
+	}
+	var netErr net.Error
+	if errors.Is(err, os.ErrDeadlineExceeded) || (errors.As(err, &netErr) && netErr.Timeout()) {
+		return &TimeoutError{Op: op, Err: err}
+	}
+	return err
+}